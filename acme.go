@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const defaultACMEHTTPAddr = ":80"
+
+// acmeHosts returns the host names to get certificates for: the host of
+// auth.info.redirect_url, the hosts of all proxies and ssl.acme.hosts.
+func acmeHosts(c *Conf) []string {
+	seen := make(map[string]bool)
+	var hosts []string
+	add := func(host string) {
+		if host != "" && !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+
+	if u, err := url.Parse(c.Auth.Info.RedirectURL); err == nil {
+		add(u.Hostname())
+	}
+	for _, p := range c.Proxies {
+		add(p.Host)
+	}
+	for _, host := range c.SSL.ACME.Hosts {
+		add(host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// newACMEManager returns the manager getting and renewing certificates for
+// ssl.acme, or nil if ACME is not configured.
+func newACMEManager(c *Conf) (*autocert.Manager, error) {
+	a := c.SSL.ACME
+	if a == nil {
+		return nil, nil
+	}
+	if c.SSL.Cert != "" || c.SSL.Key != "" || len(c.SSL.Certificates) > 0 || c.SSL.CertDir != "" {
+		return nil, errors.New("ssl.acme can't be used together with ssl.cert, ssl.key, ssl.certificates or ssl.cert_dir")
+	}
+	if a.CacheDir == "" {
+		return nil, errors.New("ssl.acme.cache_dir is required")
+	}
+	if c.SSL.OCSPStapling {
+		return nil, errors.New("ssl.ocsp_stapling can't be used with ssl.acme, only loaded certificates are stapled")
+	}
+	if c.SSL.ClientAuth == ClientAuthRequire {
+		// the ACME server has no client certificate
+		return nil, errors.New("ssl.client_auth: require can't be used with ssl.acme, TLS-ALPN-01 challenges would fail")
+	}
+	if confs, err := listenerConfs(c); err == nil {
+		if err := checkACMEHTTPAddr(c, confs); err != nil {
+			return nil, err
+		}
+	}
+	hosts := acmeHosts(c)
+	if len(hosts) == 0 {
+		return nil, errors.New("ssl.acme needs host names: set auth.info.redirect_url, proxy hosts or ssl.acme.hosts")
+	}
+
+	client := &acme.Client{DirectoryURL: a.DirectoryURL}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = acme.LetsEncryptURL
+	}
+	if a.CAFile != "" {
+		// for test servers like Pebble
+		tlsConfig, err := newUpstreamTLSConfig(UpstreamTLSConf{CAFile: a.CAFile})
+		if err != nil {
+			return nil, err
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(a.CacheDir),
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Email:      a.Email,
+		Client:     client,
+	}, nil
+}
+
+// acmeHTTPAddr returns the address to answer HTTP-01 challenges at, or "" if
+// the redirect_to_https listeners answer them.
+func acmeHTTPAddr(c *Conf, confs []ListenerConf) string {
+	switch {
+	case c.SSL.ACME.HTTPAddr != "":
+		return c.SSL.ACME.HTTPAddr
+	case hasRedirectListener(confs):
+		return ""
+	}
+	return defaultACMEHTTPAddr
+}
+
+// checkACMEHTTPAddr rejects listeners on the port of the HTTP-01 challenge
+// server, which couldn't bind it then.
+func checkACMEHTTPAddr(c *Conf, confs []ListenerConf) error {
+	addr := acmeHTTPAddr(c, confs)
+	if addr == "" {
+		return nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("ssl.acme.http_addr: %s", err)
+	}
+	for i, l := range confs {
+		if strings.HasPrefix(l.Address, unixListenerPrefix) || strings.HasPrefix(l.Address, systemdListenerPrefix) {
+			continue
+		}
+		if _, p, err := net.SplitHostPort(l.Address); err != nil || p != port {
+			continue
+		}
+		name := "address"
+		if len(c.Listeners) > 0 {
+			name = fmt.Sprintf("listeners[%d]", i)
+		}
+		return fmt.Errorf("ssl.acme: HTTP-01 challenges are answered at %s, which %s uses too; set ssl.acme.http_addr or make it a redirect_to_https listener", addr, name)
+	}
+	return nil
+}
+
+// serveACMEChallenges answers HTTP-01 challenges at addr and redirects any
+// other request to https.
+func serveACMEChallenges(c *Conf, addr string, manager *autocert.Manager) {
+	log.Printf("serving ACME HTTP-01 challenges at %s", addr)
+	server, err := newServer(&Conf{Addr: addr, Server: c.Server}, manager.HTTPHandler(nil))
+	if err != nil {
+		log.Printf("ACME HTTP-01 challenges: %s", err)
+		return
+	}
+	if err := server.ListenAndServe(); err != nil {
+		// TLS-ALPN-01 challenges still work
+		log.Printf("ACME HTTP-01 challenges: %s", err)
+	}
+}
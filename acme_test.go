@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestACMEHosts(t *testing.T) {
+	c := &Conf{
+		Auth: AuthConf{Info: AuthInfoConf{RedirectURL: "https://gate.example.com/oauth2callback"}},
+		Proxies: []ProxyConf{
+			{Path: "/", Host: "kibana.example.com"},
+			{Path: "/es", Host: "kibana.example.com"},
+			{Path: "/other"},
+		},
+		SSL: SSLConf{ACME: &ACMEConf{Hosts: []string{"extra.example.com", "gate.example.com"}}},
+	}
+	expected := []string{"extra.example.com", "gate.example.com", "kibana.example.com"}
+	if hosts := acmeHosts(c); !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("unexpected hosts: %v", hosts)
+	}
+}
+
+func TestNewACMEManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gate-acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pebble := httptest.NewTLSServer(nil)
+	defer pebble.Close()
+	caFile := writeServerCA(t, pebble)
+	defer os.Remove(caFile)
+
+	c := &Conf{
+		Auth: AuthConf{Info: AuthInfoConf{RedirectURL: "https://gate.example.com/oauth2callback"}},
+		SSL: SSLConf{ACME: &ACMEConf{
+			Email:        "admin@example.com",
+			CacheDir:     filepath.Join(dir, "cache"),
+			DirectoryURL: pebble.URL + "/dir",
+			CAFile:       caFile,
+		}},
+	}
+	m, err := newACMEManager(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Client.DirectoryURL != pebble.URL+"/dir" || m.Client.HTTPClient == nil {
+		t.Errorf("directory not configured: %+v", m.Client)
+	}
+	if err := m.HostPolicy(context.Background(), "gate.example.com"); err != nil {
+		t.Error(err)
+	}
+	if err := m.HostPolicy(context.Background(), "evil.example.net"); err == nil {
+		t.Error("certificate allowed for an unknown host")
+	}
+
+	// other requests to the challenge server are redirected to https
+	w := httptest.NewRecorder()
+	m.HTTPHandler(nil).ServeHTTP(w, httptest.NewRequest("GET", "http://gate.example.com/foo", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://gate.example.com/foo" {
+		t.Errorf("unexpected response: %d %v", w.Code, w.Header())
+	}
+}
+
+func TestNewACMEManagerErrors(t *testing.T) {
+	redirect := AuthConf{Info: AuthInfoConf{RedirectURL: "https://gate.example.com/oauth2callback"}}
+	tests := []*Conf{
+		{Auth: redirect, SSL: SSLConf{ACME: &ACMEConf{}}},
+		{Auth: redirect, SSL: SSLConf{Cert: "cert.pem", Key: "key.pem", ACME: &ACMEConf{CacheDir: "cache"}}},
+		{SSL: SSLConf{ACME: &ACMEConf{CacheDir: "cache"}}},
+		{Auth: redirect, SSL: SSLConf{ACME: &ACMEConf{CacheDir: "cache", CAFile: "/nonexistent/ca.pem"}}},
+		{Auth: redirect, SSL: SSLConf{ClientAuth: ClientAuthRequire, ACME: &ACMEConf{CacheDir: "cache"}}},
+		{Auth: redirect, SSL: SSLConf{OCSPStapling: true, ACME: &ACMEConf{CacheDir: "cache"}}},
+		// :80 is needed for HTTP-01 challenges
+		{Auth: redirect, Listeners: []ListenerConf{{Address: ":443", TLS: true}, {Address: ":80"}}, SSL: SSLConf{ACME: &ACMEConf{CacheDir: "cache"}}},
+		{Auth: redirect, Listeners: []ListenerConf{{Address: ":443", TLS: true}, {Address: ":80", RedirectToHTTPS: true}}, SSL: SSLConf{ACME: &ACMEConf{CacheDir: "cache", HTTPAddr: ":80"}}},
+	}
+	for i, c := range tests {
+		if _, err := newACMEManager(c); err == nil {
+			t.Errorf("test %d: no error", i)
+		}
+	}
+
+	for _, listeners := range [][]ListenerConf{
+		{{Address: ":443", TLS: true}, {Address: ":80", RedirectToHTTPS: true}},
+		{{Address: ":443", TLS: true}, {Address: ":8080"}},
+	} {
+		c := &Conf{Auth: redirect, Listeners: listeners, SSL: SSLConf{ACME: &ACMEConf{CacheDir: "cache"}}}
+		if _, err := newACMEManager(c); err != nil {
+			t.Errorf("unexpected error for %+v: %s", listeners, err)
+		}
+	}
+
+	if m, err := newACMEManager(&Conf{}); m != nil || err != nil {
+		t.Errorf("unexpected result without ssl.acme: %v, %v", m, err)
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Authenticator interface {
@@ -35,7 +37,7 @@ func NewAuthenticator(conf *Conf) Authenticator {
 			RedirectURL:  conf.Auth.Info.RedirectURL,
 			Scopes:       []string{"read:org"},
 		}, conf)
-		authenticator = &GitHubAuth{&BaseAuth{handler, conf}}
+		authenticator = &GitHubAuth{&BaseAuth{handler, conf}, newGitHubUserCache(), gitHubUserNeeded(conf)}
 	} else {
 		panic("unsupported authentication method")
 	}
@@ -99,17 +101,17 @@ func (a *GoogleAuth) Authenticate(domain []string, c martini.Context, tokens oau
 			for _, d := range domain {
 				if strings.Contains(d, "@") {
 					if d == email {
-						user = &User{email}
+						user = &User{Email: email}
 					}
 				} else {
 					if strings.HasSuffix(email, "@"+d) {
-						user = &User{email}
+						user = &User{Email: email}
 						break
 					}
 				}
 			}
 		} else {
-			user = &User{email}
+			user = &User{Email: email}
 		}
 
 		if user != nil {
@@ -129,9 +131,56 @@ func (a *GoogleAuth) Authenticate(domain []string, c martini.Context, tokens oau
 
 type GitHubAuth struct {
 	*BaseAuth
+	users *gitHubUserCache
+	// the login or email is used by header templates or rate limits
+	needsUser bool
+}
+
+// gitHubUserNeeded tells whether anything in conf uses the login or email
+// of the user, which needs an extra API call with GitHub.
+func gitHubUserNeeded(conf *Conf) bool {
+	headers := []HeaderConf{conf.RequestHeaders, conf.ResponseHeaders}
+	limits := []RateLimitConf{conf.RateLimit}
+	for _, p := range conf.Proxies {
+		headers = append(headers, p.RequestHeaders, p.ResponseHeaders)
+		limits = append(limits, p.RateLimit)
+	}
+	for _, h := range headers {
+		for _, values := range []map[string]string{h.Set, h.Add} {
+			for _, v := range values {
+				if strings.Contains(v, ".User.Login") || strings.Contains(v, ".User.Email") {
+					return true
+				}
+			}
+		}
+	}
+	for _, l := range limits {
+		if l.Key == RateLimitByUser {
+			return true
+		}
+	}
+	return false
 }
 
 func (a *GitHubAuth) Authenticate(organizations []string, c martini.Context, tokens oauth2.Tokens, w http.ResponseWriter, r *http.Request) {
+	user := &User{}
+	if a.needsUser || len(organizations) > 0 {
+		u, err := a.user(tokens)
+		switch {
+		case err == nil:
+			user = u
+		case len(organizations) > 0:
+			log.Printf("failed to retrieve user: %s", err)
+			forbidden(w)
+			return
+		default:
+			// nothing to restrict, so a GitHub outage doesn't lock everyone
+			// out; the user is just unknown
+			log.Printf("failed to retrieve user, continuing without login and email: %s", err)
+		}
+	}
+	c.Map(user)
+
 	if len(organizations) > 0 {
 		req, err := http.NewRequest("GET", fmt.Sprintf("%s/user/orgs", a.conf.Auth.Info.ApiEndpoint), nil)
 		if err != nil {
@@ -180,6 +229,86 @@ func (a *GitHubAuth) Authenticate(organizations []string, c martini.Context, tok
 	}
 }
 
+// user returns the GitHub user owning the access token. Users are cached for a
+// while to avoid an extra API call on every request.
+func (a *GitHubAuth) user(tokens oauth2.Tokens) (*User, error) {
+	if user := a.users.get(tokens.Access()); user != nil {
+		return user, nil
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/user", a.conf.Auth.Info.ApiEndpoint), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(tokens.Access(), "x-oauth-basic")
+
+	client := http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from GitHub: %s", res.Status)
+	}
+
+	var info struct {
+		Login string `json:"login"`
+		Email string `json:"email"`
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+
+	user := &User{Email: info.Email, Login: info.Login}
+	a.users.put(tokens.Access(), user)
+	return user, nil
+}
+
+const gitHubUserCacheTTL = 5 * time.Minute
+
+type gitHubUserCache struct {
+	mu    sync.Mutex
+	users map[string]gitHubUserCacheEntry
+}
+
+type gitHubUserCacheEntry struct {
+	user    *User
+	expires time.Time
+}
+
+func newGitHubUserCache() *gitHubUserCache {
+	return &gitHubUserCache{users: make(map[string]gitHubUserCacheEntry)}
+}
+
+func (c *gitHubUserCache) get(token string) *User {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.users[token]
+	if !ok || time.Now().After(e.expires) {
+		return nil
+	}
+	return e.user
+}
+
+func (c *gitHubUserCache) put(token string, user *User) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for t, e := range c.users {
+		if now.After(e.expires) {
+			delete(c.users, t)
+		}
+	}
+	c.users[token] = gitHubUserCacheEntry{user, now.Add(gitHubUserCacheTTL)}
+}
+
 func forbidden(w http.ResponseWriter) {
 	w.WriteHeader(403)
 	w.Write([]byte("Access denied"))
@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestGitHubUserNeeded(t *testing.T) {
+	for _, test := range []struct {
+		conf   Conf
+		needed bool
+	}{
+		{Conf{}, false},
+		{Conf{RequestHeaders: HeaderConf{Set: map[string]string{"X-Client-IP": "{{.ClientIP}}"}}}, false},
+		{Conf{RequestHeaders: HeaderConf{Set: map[string]string{"X-User": "{{.User.Login}}"}}}, true},
+		{Conf{Proxies: []ProxyConf{{ResponseHeaders: HeaderConf{Add: map[string]string{"X-Email": "{{.User.Email}}"}}}}}, true},
+		{Conf{RateLimit: RateLimitConf{Rate: "10/s"}}, false},
+		{Conf{Proxies: []ProxyConf{{RateLimit: RateLimitConf{Rate: "10/s", Key: RateLimitByUser}}}}, true},
+	} {
+		if needed := gitHubUserNeeded(&test.conf); needed != test.needed {
+			t.Errorf("%+v: expected %v, got %v", test.conf, test.needed, needed)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerMinRequests = 20
+	defaultBreakerWindow      = 10 * time.Second
+	defaultBreakerOpenTimeout = 30 * time.Second
+)
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+type breakerOutcome int
+
+const (
+	breakerSuccess breakerOutcome = iota
+	breakerFailure
+	breakerIgnored // e.g. the client went away
+)
+
+// circuitBreaker stops sending requests to a failing backend. It opens after
+// too many consecutive failures or a too high error rate within a window,
+// fails fast while open, and lets a few trial requests through (half-open)
+// after openTimeout to find out if the backend is back.
+type circuitBreaker struct {
+	name                string
+	consecutiveFailures int
+	errorRate           float64
+	minRequests         int
+	window              time.Duration
+	openTimeout         time.Duration
+	halfOpenRequests    int
+	errorPage           []byte
+
+	mu          sync.Mutex
+	state       breakerState
+	failures    int // consecutive
+	windowStart time.Time
+	requests    int // in the current window
+	errors      int // in the current window
+	openedAt    time.Time
+	trials      int // in flight while half-open
+	rejected    int64
+	opened      int64
+}
+
+type breakerStatus struct {
+	State    string  `json:"state"`
+	Failures int     `json:"consecutive_failures"`
+	Requests int     `json:"window_requests"`
+	Errors   int     `json:"window_errors"`
+	Rejected int64   `json:"rejected"`
+	Opened   int64   `json:"opened"`
+	OpenFor  float64 `json:"open_seconds,omitempty"`
+}
+
+func newCircuitBreaker(name string, c CircuitBreakerConf) (*circuitBreaker, error) {
+	if c.ConsecutiveFailures == 0 && c.ErrorRate == 0 {
+		if c != (CircuitBreakerConf{}) {
+			return nil, errors.New("circuit_breaker needs consecutive_failures or error_rate")
+		}
+		return nil, nil
+	}
+	if c.ConsecutiveFailures < 0 || c.MinRequests < 0 || c.HalfOpenRequests < 0 {
+		return nil, errors.New("circuit_breaker values must not be negative")
+	}
+	if c.ErrorRate < 0 || c.ErrorRate > 1 {
+		return nil, fmt.Errorf("circuit_breaker.error_rate must be between 0 and 1: %v", c.ErrorRate)
+	}
+
+	cb := &circuitBreaker{
+		name:                name,
+		consecutiveFailures: c.ConsecutiveFailures,
+		errorRate:           c.ErrorRate,
+		minRequests:         c.MinRequests,
+		halfOpenRequests:    c.HalfOpenRequests,
+	}
+	var err error
+	if cb.window, err = parseDuration("circuit_breaker.window", c.Window); err != nil {
+		return nil, err
+	}
+	if cb.openTimeout, err = parseDuration("circuit_breaker.open_timeout", c.OpenTimeout); err != nil {
+		return nil, err
+	}
+	if c.ErrorPage != "" {
+		if cb.errorPage, err = ioutil.ReadFile(c.ErrorPage); err != nil {
+			return nil, err
+		}
+	}
+
+	if cb.minRequests == 0 {
+		cb.minRequests = defaultBreakerMinRequests
+	}
+	if cb.window == 0 {
+		cb.window = defaultBreakerWindow
+	}
+	if cb.openTimeout == 0 {
+		cb.openTimeout = defaultBreakerOpenTimeout
+	}
+	if cb.halfOpenRequests == 0 {
+		cb.halfOpenRequests = 1
+	}
+	return cb, nil
+}
+
+// allow reports whether a request may be sent to the backend. Every allowed
+// request has to be followed by a call to record.
+func (cb *circuitBreaker) allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == breakerOpen && time.Since(cb.openedAt) >= cb.openTimeout {
+		log.Printf("circuit breaker for %s is half-open", cb.name)
+		cb.state = breakerHalfOpen
+		cb.trials = 0
+	}
+
+	switch cb.state {
+	case breakerOpen:
+		cb.rejected++
+		return false
+	case breakerHalfOpen:
+		if cb.trials >= cb.halfOpenRequests {
+			cb.rejected++
+			return false
+		}
+		cb.trials++
+	}
+	return true
+}
+
+func (cb *circuitBreaker) record(outcome breakerOutcome) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case breakerOpen:
+		// a request started before the breaker opened
+	case breakerHalfOpen:
+		switch outcome {
+		case breakerSuccess:
+			log.Printf("circuit breaker for %s is closed", cb.name)
+			cb.reset()
+		case breakerFailure:
+			cb.trip()
+		default:
+			cb.trials--
+		}
+	case breakerClosed:
+		if outcome == breakerIgnored {
+			return
+		}
+		now := time.Now()
+		if now.Sub(cb.windowStart) >= cb.window {
+			cb.windowStart = now
+			cb.requests = 0
+			cb.errors = 0
+		}
+		cb.requests++
+		if outcome == breakerSuccess {
+			cb.failures = 0
+			return
+		}
+		cb.errors++
+		cb.failures++
+
+		if cb.consecutiveFailures > 0 && cb.failures >= cb.consecutiveFailures {
+			cb.trip()
+		} else if cb.errorRate > 0 && cb.requests >= cb.minRequests &&
+			float64(cb.errors)/float64(cb.requests) >= cb.errorRate {
+			cb.trip()
+		}
+	}
+}
+
+func (cb *circuitBreaker) trip() {
+	log.Printf("circuit breaker for %s is open for %s", cb.name, cb.openTimeout)
+	cb.state = breakerOpen
+	cb.openedAt = time.Now()
+	cb.opened++
+}
+
+func (cb *circuitBreaker) reset() {
+	cb.state = breakerClosed
+	cb.failures = 0
+	cb.windowStart = time.Now()
+	cb.requests = 0
+	cb.errors = 0
+}
+
+// retryAfter returns how long the breaker will stay open.
+func (cb *circuitBreaker) retryAfter() time.Duration {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state != breakerOpen {
+		return 0
+	}
+	return cb.openTimeout - time.Since(cb.openedAt)
+}
+
+func (cb *circuitBreaker) status() breakerStatus {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	s := breakerStatus{
+		State:    cb.state.String(),
+		Failures: cb.failures,
+		Requests: cb.requests,
+		Errors:   cb.errors,
+		Rejected: cb.rejected,
+		Opened:   cb.opened,
+	}
+	if cb.state == breakerOpen {
+		s.OpenFor = time.Since(cb.openedAt).Seconds()
+	}
+	return s
+}
+
+// breakerTransport records the outcome of every request in the breaker.
+// Connection errors and 502, 503 and 504 responses count as failures.
+type breakerTransport struct {
+	transport http.RoundTripper
+	breaker   *circuitBreaker
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.breaker.allow() {
+		return nil, errCircuitOpen
+	}
+
+	res, err := t.transport.RoundTrip(req)
+	switch {
+	case err != nil && (errors.Is(err, context.Canceled) || isBodyTooLarge(err)):
+		t.breaker.record(breakerIgnored)
+	case err != nil:
+		t.breaker.record(breakerFailure)
+	case res.StatusCode == http.StatusBadGateway ||
+		res.StatusCode == http.StatusServiceUnavailable ||
+		res.StatusCode == http.StatusGatewayTimeout:
+		t.breaker.record(breakerFailure)
+	default:
+		t.breaker.record(breakerSuccess)
+	}
+	return res, err
+}
+
+// serveOpen answers requests rejected by the open breaker.
+func (cb *circuitBreaker) serveOpen(w http.ResponseWriter) {
+	if d := cb.retryAfter(); d > 0 {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(d.Seconds())+1))
+	}
+	if cb.errorPage != nil {
+		w.Header().Set("Content-Type", http.DetectContentType(cb.errorPage))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write(cb.errorPage)
+		return
+	}
+	http.Error(w, "503 Service Unavailable", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	cb, err := newCircuitBreaker("test", CircuitBreakerConf{ConsecutiveFailures: 3, OpenTimeout: "100ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if !cb.allow() {
+			t.Fatalf("closed breaker rejected request %d", i)
+		}
+		cb.record(breakerFailure)
+	}
+	if cb.status().State != "open" || cb.allow() {
+		t.Fatalf("breaker should be open: %+v", cb.status())
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if !cb.allow() {
+		t.Fatalf("half-open breaker should let a trial request through")
+	}
+	if cb.allow() {
+		t.Errorf("half-open breaker should let only one trial request through")
+	}
+	cb.record(breakerSuccess)
+	if cb.status().State != "closed" {
+		t.Errorf("breaker should be closed after a successful trial: %+v", cb.status())
+	}
+}
+
+func TestCircuitBreakerErrorRate(t *testing.T) {
+	cb, err := newCircuitBreaker("test", CircuitBreakerConf{ErrorRate: 0.5, MinRequests: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		cb.allow()
+		if i%2 == 0 {
+			cb.record(breakerSuccess)
+		} else {
+			cb.record(breakerFailure)
+		}
+	}
+	if cb.status().State != "open" {
+		t.Errorf("breaker should be open at 50%% errors: %+v", cb.status())
+	}
+}
+
+func TestCircuitBreakerProxy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := "http://" + l.Addr().String()
+	l.Close()
+
+	page, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(page.Name())
+	page.WriteString("<html><body>backend is down</body></html>")
+	page.Close()
+
+	p := ProxyConf{Dest: dest, CircuitBreaker: CircuitBreakerConf{ConsecutiveFailures: 2, ErrorPage: page.Name()}}
+	breaker, err := newCircuitBreaker(dest, p.CircuitBreaker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _, _, _ := parseDest(dest)
+	upstream, _ := newUpstreamOptions(p)
+	front := httptest.NewServer(newVirtualHostReverseProxy([]Backend{{URL: u, Upstream: upstream, Breaker: breaker}}))
+	defer front.Close()
+
+	for i, expected := range []int{502, 502, 503} {
+		res, err := http.Get(front.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != expected {
+			t.Errorf("request %d: unexpected status %s", i, res.Status)
+		}
+		if expected == 503 && (string(body) != "<html><body>backend is down</body></html>" || res.Header.Get("Retry-After") == "") {
+			t.Errorf("unexpected error page: %v %s", res.Header, body)
+		}
+	}
+}
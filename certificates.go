@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certificateCheckInterval limits how often the certificate files are
+// stat'ed for changes.
+const certificateCheckInterval = time.Second
+
+// certificateStore holds the server certificates, chosen by SNI. The first
+// one is the default for clients which don't send SNI or ask for an unknown
+// name. Changed files are loaded again; if that fails the previous
+// certificate is kept.
+type certificateStore struct {
+	pairs        []CertificateConf
+	dir          string
+	ocspStapling bool
+
+	mu      sync.Mutex
+	certs   []*loadedCertificate
+	checked time.Time
+}
+
+type loadedCertificate struct {
+	CertificateConf
+	modTime time.Time
+	cert    *tls.Certificate
+	leaf    *x509.Certificate
+
+	ocspRefresh  time.Time
+	ocspExpires  time.Time
+	ocspFetching bool
+}
+
+// newCertificateStore returns the store for ssl.cert/ssl.key,
+// ssl.certificates and ssl.cert_dir, or nil if none are configured.
+func newCertificateStore(c SSLConf) (*certificateStore, error) {
+	s := &certificateStore{dir: c.CertDir, ocspStapling: c.OCSPStapling}
+	if c.Cert != "" || c.Key != "" {
+		s.pairs = append(s.pairs, CertificateConf{Cert: c.Cert, Key: c.Key})
+	}
+	s.pairs = append(s.pairs, c.Certificates...)
+	for _, p := range s.pairs {
+		if p.Cert == "" || p.Key == "" {
+			return nil, errors.New("both cert and key are required for ssl certificates")
+		}
+	}
+	if len(s.pairs) == 0 && s.dir == "" {
+		return nil, nil
+	}
+
+	pairs, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pairs {
+		lc, err := loadCertificate(p)
+		if err != nil {
+			return nil, err
+		}
+		s.certs = append(s.certs, lc)
+	}
+	if len(s.certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", s.dir)
+	}
+	s.checked = time.Now()
+	return s, nil
+}
+
+// list returns the configured pairs followed by those in the directory:
+// every <name>.crt or <name>.pem with a <name>.key.
+func (s *certificateStore) list() ([]CertificateConf, error) {
+	pairs := append([]CertificateConf{}, s.pairs...)
+	if s.dir == "" {
+		return pairs, nil
+	}
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range files {
+		ext := filepath.Ext(fi.Name())
+		if ext != ".crt" && ext != ".pem" {
+			continue
+		}
+		key := strings.TrimSuffix(fi.Name(), ext) + ".key"
+		if _, err := os.Stat(filepath.Join(s.dir, key)); err == nil {
+			names = append(names, fi.Name())
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pairs = append(pairs, CertificateConf{
+			Cert: filepath.Join(s.dir, name),
+			Key:  filepath.Join(s.dir, strings.TrimSuffix(name, filepath.Ext(name))+".key"),
+		})
+	}
+	return pairs, nil
+}
+
+func loadCertificate(p CertificateConf) (*loadedCertificate, error) {
+	modTime, err := pairModTime(p)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(p.Cert, p.Key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &loadedCertificate{CertificateConf: p, modTime: modTime, cert: &cert, leaf: leaf}, nil
+}
+
+// pairModTime returns the later modification time of the files of p.
+func pairModTime(p CertificateConf) (time.Time, error) {
+	var modTime time.Time
+	for _, path := range []string{p.Cert, p.Key} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return modTime, err
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	return modTime, nil
+}
+
+// reload loads new and changed certificates.
+func (s *certificateStore) reload() {
+	pairs, err := s.list()
+	if err != nil {
+		log.Printf("failed to check certificates: %s", err)
+		return
+	}
+
+	loaded := make(map[CertificateConf]*loadedCertificate)
+	for _, lc := range s.certs {
+		loaded[lc.CertificateConf] = lc
+	}
+	var certs []*loadedCertificate
+	for _, p := range pairs {
+		lc := loaded[p]
+		if modTime, err := pairModTime(p); err == nil && lc != nil && modTime.Equal(lc.modTime) {
+			certs = append(certs, lc)
+			continue
+		}
+		reloaded, err := loadCertificate(p)
+		if err != nil {
+			log.Printf("failed to load certificate %s: %s", p.Cert, err)
+		} else {
+			log.Printf("loaded certificate %s for %s", p.Cert, strings.Join(reloaded.leaf.DNSNames, ", "))
+			lc = reloaded
+		}
+		if lc != nil {
+			certs = append(certs, lc)
+		}
+	}
+	if len(certs) > 0 {
+		s.certs = certs
+	}
+}
+
+func (s *certificateStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now := time.Now(); now.Sub(s.checked) >= certificateCheckInterval {
+		s.checked = now
+		s.reload()
+		if s.ocspStapling {
+			s.refreshOCSP(now)
+		}
+	}
+
+	if name := strings.TrimSuffix(hello.ServerName, "."); name != "" {
+		for _, lc := range s.certs {
+			if lc.leaf.VerifyHostname(name) == nil {
+				return lc.cert, nil
+			}
+		}
+	}
+	return s.certs[0].cert, nil
+}
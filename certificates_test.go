@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate for hosts to
+// dir/name.crt and dir/name.key.
+func writeTestCertificate(t *testing.T, dir, name string, hosts ...string) CertificateConf {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := CertificateConf{Cert: filepath.Join(dir, name+".crt"), Key: filepath.Join(dir, name+".key")}
+	ioutil.WriteFile(c.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(c.Key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return c
+}
+
+func servedName(t *testing.T, s *certificateStore, serverName string) string {
+	cert, err := s.getCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertificateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gate-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certDir := filepath.Join(dir, "certs")
+	os.Mkdir(certDir, 0755)
+
+	def := writeTestCertificate(t, dir, "default", "gate.example.com")
+	other := writeTestCertificate(t, dir, "other", "other.example.org")
+	writeTestCertificate(t, certDir, "wildcard", "*.example.net")
+
+	s, err := newCertificateStore(SSLConf{
+		Cert:         def.Cert,
+		Key:          def.Key,
+		Certificates: []CertificateConf{other},
+		CertDir:      certDir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		serverName string
+		expected   string
+	}{
+		{"gate.example.com", "gate.example.com"},
+		{"other.example.org", "other.example.org"},
+		{"Other.Example.org.", "other.example.org"},
+		{"kibana.example.net", "*.example.net"},
+		{"unknown.example.com", "gate.example.com"},
+		{"", "gate.example.com"},
+	}
+	for _, test := range tests {
+		if name := servedName(t, s, test.serverName); name != test.expected {
+			t.Errorf("%q: got certificate for %s", test.serverName, name)
+		}
+	}
+
+	// replaced and added files are picked up
+	writeTestCertificate(t, dir, "other", "renewed.example.org")
+	writeTestCertificate(t, certDir, "new", "new.example.net")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(other.Cert, future, future)
+	s.checked = time.Time{}
+
+	if name := servedName(t, s, "renewed.example.org"); name != "renewed.example.org" {
+		t.Errorf("changed certificate not reloaded: %s", name)
+	}
+	if name := servedName(t, s, "new.example.net"); name != "new.example.net" {
+		t.Errorf("new certificate not loaded: %s", name)
+	}
+
+	// a broken file keeps the previous certificate
+	ioutil.WriteFile(def.Cert, []byte("broken"), 0644)
+	future = future.Add(time.Minute)
+	os.Chtimes(def.Cert, future, future)
+	s.checked = time.Time{}
+	if name := servedName(t, s, "gate.example.com"); name != "gate.example.com" {
+		t.Errorf("certificate lost after a failed reload: %s", name)
+	}
+}
+
+func TestCertificateStoreErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gate-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []SSLConf{
+		{Cert: "cert.pem"},
+		{Certificates: []CertificateConf{{Cert: "cert.pem"}}},
+		{Cert: filepath.Join(dir, "missing.crt"), Key: filepath.Join(dir, "missing.key")},
+		{CertDir: dir},
+		{CertDir: filepath.Join(dir, "missing")},
+	}
+	for i, c := range tests {
+		if _, err := newCertificateStore(c); err == nil {
+			t.Errorf("test %d: no error", i)
+		}
+	}
+
+	if s, err := newCertificateStore(SSLConf{}); s != nil || err != nil {
+		t.Errorf("unexpected result without certificates: %v, %v", s, err)
+	}
+}
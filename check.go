@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/martini-contrib/oauth2"
+)
+
+// checkConf validates the config file more thoroughly than ParseConf and
+// returns every problem found instead of the first one.
+func checkConf(path string) []string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	c, problems, err := decodeConf(data)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	missing := checkFiles(c)
+	problems = append(problems, missing...)
+	if len(missing) == 0 {
+		// validateConf would only report the first missing file again
+		if err := validateConf(c); err != nil {
+			return append(problems, err.Error())
+		}
+	}
+	problems = append(problems, checkRoutes(c)...)
+	return append(problems, checkAuth(c)...)
+}
+
+// checkFiles returns the files and directories named in c which don't
+// exist.
+func checkFiles(c *Conf) []string {
+	type file struct {
+		setting, path string
+	}
+	files := []file{
+		{"ssl.cert", c.SSL.Cert},
+		{"ssl.key", c.SSL.Key},
+		{"ssl.cert_dir", c.SSL.CertDir},
+		{"ssl.client_ca", c.SSL.ClientCA},
+		{"htdocs", c.Htdocs},
+	}
+	for i, pair := range c.SSL.Certificates {
+		files = append(files,
+			file{fmt.Sprintf("ssl.certificates[%d].cert", i), pair.Cert},
+			file{fmt.Sprintf("ssl.certificates[%d].key", i), pair.Key})
+	}
+	if c.SSL.ACME != nil {
+		files = append(files, file{"ssl.acme.ca_file", c.SSL.ACME.CAFile})
+	}
+	for i, p := range c.Proxies {
+		name := fmt.Sprintf("proxy[%d]", i)
+		files = append(files,
+			file{name + ".tls.ca_file", p.TLS.CAFile},
+			file{name + ".tls.cert", p.TLS.CertFile},
+			file{name + ".tls.key", p.TLS.KeyFile},
+			file{name + ".upstream_auth.bearer_file", p.UpstreamAuth.BearerFile},
+			file{name + ".circuit_breaker.error_page", p.CircuitBreaker.ErrorPage})
+	}
+
+	var problems []string
+	for _, f := range files {
+		if f.path == "" {
+			continue
+		}
+		if _, err := os.Stat(f.path); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", f.setting, err))
+		}
+	}
+	return problems
+}
+
+// checkRoutes finds dests which can't be proxied to and routes which never
+// get a request.
+func checkRoutes(c *Conf) []string {
+	var problems []string
+	for i, p := range c.Proxies {
+		if p.Path == "" || !strings.HasPrefix(p.Path, "/") {
+			problems = append(problems, fmt.Sprintf("proxy[%d]: path must start with /: %s", i, c.shown(fmt.Sprintf("proxy[%d].path", i), strconv.Quote(p.Path))))
+		}
+		if strings.HasPrefix(p.Dest, "unix://") {
+			continue
+		}
+		u, err := url.Parse(p.Dest)
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("proxy[%d]: %s", i, c.destError(i, err)))
+		case u.Scheme != "http" && u.Scheme != "https":
+			problems = append(problems, fmt.Sprintf("proxy[%d]: dest must be an http, https or unix URL: %s", i, c.shownDest(i)))
+		case u.Host == "":
+			problems = append(problems, fmt.Sprintf("proxy[%d]: dest has no host: %s", i, c.shownDest(i)))
+		case u.Path != "" && u.Path != "/":
+			problems = append(problems, fmt.Sprintf("proxy[%d]: the path of dest %s is not used, requests keep their path", i, c.shownDest(i)))
+		}
+	}
+
+	groups := routeTable(c)
+	for i, group := range groups {
+		for j, r := range group {
+			for _, later := range group[j+1:] {
+				if later.proxy.Host == r.proxy.Host {
+					problems = append(problems, fmt.Sprintf("proxy[%d] and proxy[%d] both route host %s and path %s, proxy[%d] is never used",
+						r.index, later.index, c.shown(fmt.Sprintf("proxy[%d].host", r.index), strconv.Quote(r.proxy.Host)), c.shownPrefix(r), r.index))
+					break
+				}
+			}
+		}
+		for _, earlier := range groups[:i] {
+			if strings.HasPrefix(group[0].prefix, earlier[0].prefix) {
+				problems = append(problems, fmt.Sprintf("proxy[%d] %s is never used, proxy[%d] %s comes first and matches it too",
+					group[0].index, c.shownPrefix(group[0]), earlier[0].index, c.shownPrefix(earlier[0])))
+				break
+			}
+		}
+	}
+	return problems
+}
+
+// checkAuth finds auth settings which contradict each other.
+func checkAuth(c *Conf) []string {
+	info := c.Auth.Info
+	if info.Service == noAuthServiceName {
+		return nil
+	}
+
+	var problems []string
+	if info.Service != "google" && info.Service != "github" {
+		problems = append(problems, fmt.Sprintf("auth.info.service must be google or github: %s", c.shown("auth.info.service", info.Service)))
+	}
+	if info.Service != "github" && (info.Endpoint != "" || info.ApiEndpoint != "") {
+		problems = append(problems, "auth.info.endpoint and api_endpoint are only used with github")
+	}
+
+	u, err := url.Parse(info.RedirectURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return append(problems, fmt.Sprintf("auth.info.redirect_url must be an absolute http or https URL: %s", c.shown("auth.info.redirect_url", info.RedirectURL)))
+	}
+	callback := oauth2.PathCallback
+	if c.Paths.Callback != "" {
+		callback = c.Paths.Callback
+	}
+	if u.Path != callback {
+		problems = append(problems, fmt.Sprintf("the path of auth.info.redirect_url is %s, but callbacks are handled at %s (paths.callback)",
+			c.shown("auth.info.redirect_url", u.Path), c.shown("paths.callback", callback)))
+	}
+	if domain := strings.TrimPrefix(c.Auth.Session.CookieDomain, "."); domain != "" {
+		if host := u.Hostname(); host != domain && !strings.HasSuffix(host, "."+domain) {
+			problems = append(problems, fmt.Sprintf("auth.session.cookie_domain %s doesn't cover %s, the host of auth.info.redirect_url",
+				c.shown("auth.session.cookie_domain", c.Auth.Session.CookieDomain), c.shown("auth.info.redirect_url", host)))
+		}
+	}
+	if info.Service == "google" {
+		for i, r := range c.Restrictions {
+			if !strings.Contains(r, ".") {
+				problems = append(problems, fmt.Sprintf("restriction %s looks like a GitHub organization, but auth.info.service is google",
+					c.shown(fmt.Sprintf("restrictions[%d]", i), r)))
+			}
+		}
+	}
+	return problems
+}
+
+// shown returns the value of the setting at path for messages. Values from
+// the environment or a file are masked.
+func (c *Conf) shown(path, value string) string {
+	if c.secrets[path] {
+		return maskSecret(value)
+	}
+	return value
+}
+
+func (c *Conf) shownDest(i int) string {
+	return c.shown(fmt.Sprintf("proxy[%d].dest", i), redactedDest(c.Proxies[i].Dest))
+}
+
+func (c *Conf) shownPrefix(r route) string {
+	return c.shown(fmt.Sprintf("proxy[%d].path", r.index), r.prefix)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func writeTestConf(t *testing.T, data string) string {
+	f, err := ioutil.TempFile("", "gate-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString(data)
+	return f.Name()
+}
+
+func TestCheckSampleConf(t *testing.T) {
+	defaultOAuthPaths()
+	var out bytes.Buffer
+	if status := checkCommand("config_sample.yml", nil, &out); status != 0 {
+		t.Errorf("sample config not OK:\n%s", out.String())
+	}
+}
+
+func TestCheckConf(t *testing.T) {
+	defaultOAuthPaths()
+	conf := writeTestConf(t, `
+address: ":9999"
+auth:
+  session:
+    key: secret
+    cookie_domain: example.org
+  info:
+    service: google
+    client_id: dummy
+    client_secret: dummy
+    redirect_url: https://gate.example.com/callback
+    endpoint: https://github.example.com
+restrictions:
+  - example.com
+  - my-github-org
+proxy:
+  - path: /
+    dest: http://127.0.0.1:8080/app
+  - path: /api
+    dest: http://127.0.0.1:8081
+    stirp_path: yes
+  - path: /kibana
+    host: a.example.com
+    dest: http://127.0.0.1:5601
+  - path: /kibana/
+    host: a.example.com
+    dest: http://127.0.0.1:5602
+`)
+	defer os.Remove(conf)
+
+	expected := []string{
+		"unknown key: proxy[1].stirp_path",
+		"proxy[0]: the path of dest http://127.0.0.1:8080/app is not used",
+		"proxy[2] and proxy[3] both route host \"a.example.com\" and path /kibana/",
+		"proxy[1] /api/ is never used, proxy[0] / comes first",
+		"proxy[2] /kibana/ is never used, proxy[0] / comes first",
+		"auth.info.endpoint and api_endpoint are only used with github",
+		"the path of auth.info.redirect_url is /callback",
+		"auth.session.cookie_domain example.org doesn't cover gate.example.com",
+		"restriction my-github-org looks like a GitHub organization",
+	}
+	problems := checkConf(conf)
+	if len(problems) != len(expected) {
+		t.Errorf("unexpected problems:\n%s", strings.Join(problems, "\n"))
+	}
+	for _, e := range expected {
+		found := false
+		for _, p := range problems {
+			if strings.Contains(p, e) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("problem not found: %s", e)
+		}
+	}
+}
+
+func TestCheckConfFiles(t *testing.T) {
+	conf := writeTestConf(t, `
+address: ":9999"
+ssl:
+  cert: /nonexistent/gate.crt
+  key: /nonexistent/gate.key
+auth:
+  session:
+    key: secret
+  info:
+    service: github
+    client_id: dummy
+    client_secret: dummy
+    redirect_url: https://gate.example.com/oauth2callback
+proxy:
+  - path: /
+    dest: https://127.0.0.1:8443
+    tls:
+      ca_file: /nonexistent/ca.pem
+`)
+	defer os.Remove(conf)
+
+	problems := checkConf(conf)
+	if len(problems) != 3 ||
+		!strings.HasPrefix(problems[0], "ssl.cert: ") ||
+		!strings.HasPrefix(problems[1], "ssl.key: ") ||
+		!strings.HasPrefix(problems[2], "proxy[0].tls.ca_file: ") {
+		t.Errorf("unexpected problems:\n%s", strings.Join(problems, "\n"))
+	}
+}
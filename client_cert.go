@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/go-martini/martini"
+)
+
+// ssl.client_auth values
+const (
+	ClientAuthRequest = "request"
+	ClientAuthRequire = "require"
+)
+
+// client_cert values
+const (
+	ClientCertAlternative = "alternative" // instead of OAuth
+	ClientCertRequired    = "required"    // in addition to OAuth
+)
+
+// clientIdentity is taken from a verified client certificate.
+type clientIdentity struct {
+	CommonName string
+	Email      string
+	SPIFFEID   string
+}
+
+func identityFromCertificate(cert *x509.Certificate) *clientIdentity {
+	id := &clientIdentity{CommonName: cert.Subject.CommonName}
+	if len(cert.EmailAddresses) > 0 {
+		id.Email = cert.EmailAddresses[0]
+	}
+	for _, u := range cert.URIs {
+		if u.Scheme == "spiffe" {
+			id.SPIFFEID = u.String()
+			break
+		}
+	}
+	return id
+}
+
+func (id *clientIdentity) String() string {
+	switch {
+	case id.SPIFFEID != "":
+		return id.SPIFFEID
+	case id.Email != "":
+		return id.Email
+	}
+	return id.CommonName
+}
+
+// fill adds the identity to u, keeping an email address from OAuth.
+func (id *clientIdentity) fill(u *User) {
+	if u.Email == "" {
+		u.Email = id.Email
+	}
+	u.CommonName = id.CommonName
+	u.SPIFFEID = id.SPIFFEID
+}
+
+// loadClientCAs returns the TLS settings for ssl.client_ca and
+// ssl.client_auth.
+func loadClientCAs(c SSLConf) (*x509.CertPool, tls.ClientAuthType, error) {
+	if c.ClientCA == "" {
+		if c.ClientAuth != "" {
+			return nil, tls.NoClientCert, errors.New("ssl.client_ca is required for ssl.client_auth")
+		}
+		return nil, tls.NoClientCert, nil
+	}
+
+	clientAuth := tls.VerifyClientCertIfGiven
+	switch c.ClientAuth {
+	case "", ClientAuthRequest:
+	case ClientAuthRequire:
+		clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, tls.NoClientCert, fmt.Errorf("invalid ssl.client_auth: %s (must be %s or %s)", c.ClientAuth, ClientAuthRequest, ClientAuthRequire)
+	}
+
+	data, err := ioutil.ReadFile(c.ClientCA)
+	if err != nil {
+		return nil, tls.NoClientCert, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, tls.NoClientCert, fmt.Errorf("no certificates found in %s", c.ClientCA)
+	}
+	return pool, clientAuth, nil
+}
+
+// clientCertPolicy authenticates requests by verified client certificates
+// matching ssl.client_restrictions.
+type clientCertPolicy struct {
+	restrictions []string
+	routes       []clientCertRoute
+}
+
+type clientCertRoute struct {
+	prefix string
+	proxy  *virtualHostProxy
+}
+
+// newClientCertPolicy returns nil if ssl.client_ca is not set.
+func newClientCertPolicy(c SSLConf) (*clientCertPolicy, error) {
+	if c.ClientCA == "" {
+		if len(c.ClientRestrictions) > 0 {
+			return nil, errors.New("ssl.client_ca is required for ssl.client_restrictions")
+		}
+		return nil, nil
+	}
+	for _, r := range c.ClientRestrictions {
+		if !strings.HasPrefix(r, "spiffe://") && !strings.HasPrefix(r, "cn:") && !strings.HasPrefix(r, "email:") {
+			return nil, fmt.Errorf("invalid ssl.client_restrictions entry: %s (must start with cn:, email: or spiffe://)", r)
+		}
+	}
+	return &clientCertPolicy{restrictions: c.ClientRestrictions}, nil
+}
+
+// addRoute registers the proxies at prefix, so requests can be matched to
+// their backend before routing.
+func (p *clientCertPolicy) addRoute(prefix string, proxy *virtualHostProxy) {
+	p.routes = append(p.routes, clientCertRoute{prefix, proxy})
+}
+
+// backendFor returns the backend a request is going to be routed to, or nil.
+// Like the router, the first matching route wins.
+func (p *clientCertPolicy) backendFor(r *http.Request) *Backend {
+	for _, route := range p.routes {
+		if strings.HasPrefix(r.URL.Path, route.prefix) {
+			return route.proxy.backendFor(r)
+		}
+	}
+	return nil
+}
+
+func (p *clientCertPolicy) allowed(id *clientIdentity) bool {
+	if len(p.restrictions) == 0 {
+		return true
+	}
+	for _, r := range p.restrictions {
+		switch {
+		case strings.HasPrefix(r, "cn:"):
+			if id.CommonName != "" && id.CommonName == r[len("cn:"):] {
+				return true
+			}
+		case strings.HasPrefix(r, "email:"):
+			email := r[len("email:"):]
+			if strings.Contains(email, "@") && id.Email == email ||
+				!strings.Contains(email, "@") && strings.HasSuffix(id.Email, "@"+email) {
+				return true
+			}
+		case strings.HasSuffix(r, "/*"):
+			if strings.HasPrefix(id.SPIFFEID, r[:len(r)-1]) {
+				return true
+			}
+		default:
+			if id.SPIFFEID == r {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// identify returns the identity of the verified client certificate of r, or
+// nil if there is none or it's not allowed.
+func (p *clientCertPolicy) identify(r *http.Request) *clientIdentity {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	id := identityFromCertificate(r.TLS.VerifiedChains[0][0])
+	if !p.allowed(id) {
+		log.Printf("client certificate of %s is not allowed", id)
+		return nil
+	}
+	return id
+}
+
+// Handler maps the client identity. On routes where client_cert is
+// required, requests without an allowed certificate are denied and OAuth is
+// still needed; elsewhere an allowed certificate logs the user in instead of
+// OAuth.
+func (p *clientCertPolicy) Handler() martini.Handler {
+	return func(c martini.Context, w http.ResponseWriter, r *http.Request) {
+		required := false
+		if b := p.backendFor(r); b != nil {
+			required = b.ClientCert == ClientCertRequired
+		}
+
+		id := p.identify(r)
+		if id == nil {
+			if required {
+				log.Printf("client certificate required for %s", r.URL.Path)
+				forbidden(w)
+			}
+			return
+		}
+
+		c.Map(id)
+		if !required {
+			log.Printf("client %s authenticated by certificate", id)
+			user := &User{}
+			id.fill(user)
+			c.Map(user)
+		}
+	}
+}
+
+func identityFromContext(c martini.Context) *clientIdentity {
+	v := c.Get(reflect.TypeOf((*clientIdentity)(nil)))
+	if !v.IsValid() {
+		return nil
+	}
+	id, _ := v.Interface().(*clientIdentity)
+	return id
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func newTestClientCertificate(t *testing.T, ca *x509.Certificate, caKey crypto.Signer, cn, email, spiffe string) tls.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: cn},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if email != "" {
+		template.EmailAddresses = []string{email}
+	}
+	if spiffe != "" {
+		u, _ := url.Parse(spiffe)
+		template.URIs = []*url.URL{u}
+	}
+	return issueTestCertificate(t, template, ca, caKey)
+}
+
+func TestClientCertRestrictions(t *testing.T) {
+	tests := []struct {
+		restrictions []string
+		id           clientIdentity
+		allowed      bool
+	}{
+		{nil, clientIdentity{CommonName: "anyone"}, true},
+		{[]string{"cn:deploy-bot"}, clientIdentity{CommonName: "deploy-bot"}, true},
+		{[]string{"cn:deploy-bot"}, clientIdentity{CommonName: "other-bot"}, false},
+		{[]string{"email:alice@example.com"}, clientIdentity{Email: "alice@example.com"}, true},
+		{[]string{"email:example.com"}, clientIdentity{Email: "bob@example.com"}, true},
+		{[]string{"email:example.com"}, clientIdentity{Email: "bob@example.com.evil.net"}, false},
+		{[]string{"spiffe://example.org/ns/prod/sa/api"}, clientIdentity{SPIFFEID: "spiffe://example.org/ns/prod/sa/api"}, true},
+		{[]string{"spiffe://example.org/ns/prod/*"}, clientIdentity{SPIFFEID: "spiffe://example.org/ns/prod/sa/api"}, true},
+		{[]string{"spiffe://example.org/ns/prod/*"}, clientIdentity{SPIFFEID: "spiffe://example.org/ns/dev/sa/api"}, false},
+		{[]string{"cn:deploy-bot", "spiffe://example.org/*"}, clientIdentity{SPIFFEID: "spiffe://example.org/x"}, true},
+	}
+	for i, test := range tests {
+		p, err := newClientCertPolicy(SSLConf{ClientCA: "ca.pem", ClientRestrictions: test.restrictions})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed := p.allowed(&test.id); allowed != test.allowed {
+			t.Errorf("test %d: unexpected result %v", i, allowed)
+		}
+	}
+
+	if _, err := newClientCertPolicy(SSLConf{ClientCA: "ca.pem", ClientRestrictions: []string{"deploy-bot"}}); err == nil {
+		t.Error("restriction without prefix accepted")
+	}
+	if _, err := newClientCertPolicy(SSLConf{ClientRestrictions: []string{"cn:deploy-bot"}}); err == nil {
+		t.Error("restrictions without client_ca accepted")
+	}
+}
+
+func TestClientCertIdentity(t *testing.T) {
+	ca, caKey := newTestCA(t)
+	caFile, err := ioutil.TempFile("", "gate-client-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+	caFile.Close()
+
+	p, err := newClientCertPolicy(SSLConf{ClientCA: caFile.Name(), ClientRestrictions: []string{"spiffe://example.org/*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := p.identify(r); id != nil {
+			user := &User{}
+			id.fill(user)
+			fmt.Fprintf(w, "%s|%s|%s", user.CommonName, user.Email, user.SPIFFEID)
+		}
+	}))
+	server.TLS = &tls.Config{}
+	if err := configureServerTLS(server.TLS, SSLConf{ClientCA: caFile.Name()}); err != nil {
+		t.Fatal(err)
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(certs ...tls.Certificate) (string, error) {
+		// a new connection for every certificate
+		transport := server.Client().Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.Certificates = certs
+		res, err := (&http.Client{Transport: transport}).Get(server.URL)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return string(body), nil
+	}
+
+	allowed := newTestClientCertificate(t, ca, caKey, "api", "api@example.org", "spiffe://example.org/ns/prod/sa/api")
+	if body, err := get(allowed); err != nil || body != "api|api@example.org|spiffe://example.org/ns/prod/sa/api" {
+		t.Errorf("unexpected identity: %q, %v", body, err)
+	}
+
+	other := newTestClientCertificate(t, ca, caKey, "other", "", "spiffe://other.org/sa/api")
+	if body, err := get(other); err != nil || body != "" {
+		t.Errorf("certificate not matching the restrictions accepted: %q, %v", body, err)
+	}
+
+	if body, err := get(); err != nil || body != "" {
+		t.Errorf("unexpected response without certificate: %q, %v", body, err)
+	}
+
+	unknownCA, unknownKey := newTestCA(t)
+	if _, err := get(newTestClientCertificate(t, unknownCA, unknownKey, "api", "", "spiffe://example.org/sa/api")); err == nil {
+		t.Error("certificate of an unknown CA accepted")
+	}
+
+	pool, clientAuth, err := loadClientCAs(SSLConf{ClientCA: caFile.Name(), ClientAuth: ClientAuthRequire})
+	if err != nil || pool == nil || clientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("unexpected settings for require: %v, %v", clientAuth, err)
+	}
+	if _, _, err := loadClientCAs(SSLConf{ClientAuth: ClientAuthRequire}); err == nil {
+		t.Error("client_auth without client_ca accepted")
+	}
+}
+
+func TestClientCertRoutes(t *testing.T) {
+	u, _ := url.Parse("http://127.0.0.1:9200")
+	p := &clientCertPolicy{}
+	p.addRoute("/es/", newVirtualHostReverseProxy([]Backend{
+		{URL: u, ClientCert: ClientCertRequired},
+		{URL: u, Host: "public.example.com"},
+	}))
+	p.addRoute("/", newVirtualHostReverseProxy([]Backend{{URL: u}}))
+
+	tests := []struct {
+		url      string
+		required bool
+	}{
+		{"https://gate.example.com/es/_search", true},
+		{"https://public.example.com/es/_search", false},
+		{"https://gate.example.com/kibana/", false},
+	}
+	for _, test := range tests {
+		b := p.backendFor(httptest.NewRequest("GET", test.url, nil))
+		if b == nil || (b.ClientCert == ClientCertRequired) != test.required {
+			t.Errorf("%s: unexpected backend %+v", test.url, b)
+		}
+	}
+}
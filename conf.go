@@ -1,9 +1,12 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
-	"gopkg.in/yaml.v1"
+	"fmt"
 	"io/ioutil"
+	"strings"
+	"time"
 	"github.com/martini-contrib/oauth2"
 )
 
@@ -11,21 +14,96 @@ const (
 	noAuthServiceName = "nothing" // for testing only (undocumented)
 )
 
+// host_header modes
+const (
+	HostHeaderPreserve = "preserve"
+	HostHeaderUpstream = "upstream"
+)
+
+// protocol values
+const (
+	ProtocolHTTP1 = "http/1.1"
+	ProtocolH2    = "h2"  // HTTP/2 over TLS
+	ProtocolH2C   = "h2c" // HTTP/2 without TLS
+)
+
+// websocket.upgrade values
+const (
+	WebSocketAllow = "allow"
+	WebSocketDeny  = "deny"
+)
+
 type Conf struct {
-	Addr         string      `yaml:"address"`
-	SSL          SSLConf     `yaml:"ssl"`
-	Auth         AuthConf    `yaml:"auth"`
-	Restrictions []string    `yaml:"restrictions"`
-	Proxies      []ProxyConf `yaml:"proxy"`
-	Paths        PathConf    `yaml:"paths"`
-	Htdocs       string      `yaml:"htdocs"`
+	Addr            string         `yaml:"address"`
+	Listeners       []ListenerConf `yaml:"listeners"`
+	SSL             SSLConf        `yaml:"ssl"`
+	Auth            AuthConf       `yaml:"auth"`
+	Restrictions    []string       `yaml:"restrictions"`
+	Proxies         []ProxyConf    `yaml:"proxy"`
+	Paths           PathConf       `yaml:"paths"`
+	Htdocs          string         `yaml:"htdocs"`
+	RequestHeaders  HeaderConf     `yaml:"request_headers"`
+	ResponseHeaders HeaderConf     `yaml:"response_headers"`
+	TrustedProxies  []string       `yaml:"trusted_proxies"`
+	Admin           AdminConf      `yaml:"admin"`
+	RateLimit       RateLimitConf  `yaml:"rate_limit"`
+	MaxBodySize     string         `yaml:"max_body_size"`
+	Server          ServerConf     `yaml:"server"`
+	Reload          ReloadConf     `yaml:"reload"`
+
+	// settings read from _file, which are masked in logs
+	secrets map[string]bool
+}
+
+type ListenerConf struct {
+	Address         string `yaml:"address"`
+	TLS             bool   `yaml:"tls"`
+	RedirectToHTTPS bool   `yaml:"redirect_to_https"`
+}
+
+type AdminConf struct {
+	Path string `yaml:"path"`
 }
 
 type SSLConf struct {
+	Cert         string            `yaml:"cert"`
+	Key          string            `yaml:"key"`
+	Certificates []CertificateConf `yaml:"certificates"`
+	CertDir      string            `yaml:"cert_dir"`
+	ACME         *ACMEConf         `yaml:"acme"`
+
+	MinVersion     string   `yaml:"min_version"`
+	CipherSuites   []string `yaml:"cipher_suites"`
+	Curves         []string `yaml:"curves"`
+	SessionTickets *bool    `yaml:"session_tickets"`
+	OCSPStapling   bool     `yaml:"ocsp_stapling"`
+	HSTS           HSTSConf `yaml:"hsts"`
+
+	ClientCA           string   `yaml:"client_ca"`
+	ClientAuth         string   `yaml:"client_auth"`
+	ClientRestrictions []string `yaml:"client_restrictions"`
+}
+
+type HSTSConf struct {
+	MaxAge            int  `yaml:"max_age"`
+	IncludeSubDomains bool `yaml:"include_subdomains"`
+	Preload           bool `yaml:"preload"`
+}
+
+type CertificateConf struct {
 	Cert string `yaml:"cert"`
 	Key  string `yaml:"key"`
 }
 
+type ACMEConf struct {
+	Email        string   `yaml:"email"`
+	CacheDir     string   `yaml:"cache_dir"`
+	DirectoryURL string   `yaml:"directory_url"`
+	CAFile       string   `yaml:"ca_file"`
+	HTTPAddr     string   `yaml:"http_addr"`
+	Hosts        []string `yaml:"hosts"`
+}
+
 type AuthConf struct {
 	Session AuthSessionConf `yaml:"session"`
 	Info    AuthInfoConf    `yaml:"info"`
@@ -46,10 +124,106 @@ type AuthInfoConf struct {
 }
 
 type ProxyConf struct {
-	Path  string `yaml:"path"`
-	Dest  string `yaml:"dest"`
-	Strip bool   `yaml:"strip_path"`
-	Host  string `yaml:"host"`
+	Path            string             `yaml:"path"`
+	Dest            string             `yaml:"dest"`
+	Members         []string           `yaml:"members"`
+	Strip           bool               `yaml:"strip_path"`
+	Host            string             `yaml:"host"`
+	RewriteBody     bool               `yaml:"rewrite_body"`
+	RewriteTypes    []string           `yaml:"rewrite_types"`
+	RequestHeaders  HeaderConf         `yaml:"request_headers"`
+	ResponseHeaders HeaderConf         `yaml:"response_headers"`
+	UpstreamAuth    UpstreamAuthConf   `yaml:"upstream_auth"`
+	HostHeader      string             `yaml:"host_header"`
+	WebSocket       WebSocketConf      `yaml:"websocket"`
+	TLS             UpstreamTLSConf    `yaml:"tls"`
+	Timeouts        TimeoutConf        `yaml:"timeouts"`
+	Retry           RetryConf          `yaml:"retry"`
+	Pool            PoolConf           `yaml:"pool"`
+	CircuitBreaker  CircuitBreakerConf `yaml:"circuit_breaker"`
+	FlushInterval   string             `yaml:"flush_interval"`
+	Protocol        string             `yaml:"protocol"`
+	RateLimit       RateLimitConf      `yaml:"rate_limit"`
+	MaxBodySize     string             `yaml:"max_body_size"`
+	ClientCert      string             `yaml:"client_cert"`
+}
+
+type CircuitBreakerConf struct {
+	ConsecutiveFailures int     `yaml:"consecutive_failures"`
+	ErrorRate           float64 `yaml:"error_rate"`
+	MinRequests         int     `yaml:"min_requests"`
+	Window              string  `yaml:"window"`
+	OpenTimeout         string  `yaml:"open_timeout"`
+	HalfOpenRequests    int     `yaml:"half_open_requests"`
+	ErrorPage           string  `yaml:"error_page"`
+}
+
+type ServerConf struct {
+	ReadHeaderTimeout string `yaml:"read_header_timeout"`
+	ReadTimeout       string `yaml:"read_timeout"`
+	WriteTimeout      string `yaml:"write_timeout"`
+	IdleTimeout       string `yaml:"idle_timeout"`
+	MaxHeaderBytes    int    `yaml:"max_header_bytes"`
+	ShutdownTimeout   string `yaml:"shutdown_timeout"`
+}
+
+type ReloadConf struct {
+	Watch    bool   `yaml:"watch"`
+	Interval string `yaml:"interval"`
+}
+
+type RateLimitConf struct {
+	Rate  string `yaml:"rate"`
+	Burst int    `yaml:"burst"`
+	Key   string `yaml:"key"`
+}
+
+type TimeoutConf struct {
+	Dial           string `yaml:"dial"`
+	TLSHandshake   string `yaml:"tls_handshake"`
+	ResponseHeader string `yaml:"response_header"`
+	Overall        string `yaml:"overall"`
+}
+
+type RetryConf struct {
+	Attempts int    `yaml:"attempts"`
+	Backoff  string `yaml:"backoff"`
+}
+
+type PoolConf struct {
+	MaxIdleConnsPerHost int `yaml:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int `yaml:"max_conns_per_host"`
+}
+
+type UpstreamTLSConf struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert"`
+	KeyFile            string `yaml:"key"`
+	ServerName         string `yaml:"server_name"`
+	MinVersion         string `yaml:"min_version"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+type WebSocketConf struct {
+	Upgrade          string   `yaml:"upgrade"`
+	AllowedOrigins   []string `yaml:"allowed_origins"`
+	Subprotocols     []string `yaml:"subprotocols"`
+	ConnectTimeout   string   `yaml:"connect_timeout"`
+	HandshakeTimeout string   `yaml:"handshake_timeout"`
+	IdleTimeout      string   `yaml:"idle_timeout"`
+}
+
+type UpstreamAuthConf struct {
+	Username   string `yaml:"username"`
+	Password   string `yaml:"password"`
+	Bearer     string `yaml:"bearer"`
+	BearerFile string `yaml:"bearer_file"`
+}
+
+type HeaderConf struct {
+	Set    map[string]string `yaml:"set"`
+	Add    map[string]string `yaml:"add"`
+	Delete []string          `yaml:"delete"`
 }
 
 type PathConf struct {
@@ -65,35 +239,147 @@ func ParseConf(path string) (*Conf, error) {
 		return nil, err
 	}
 
-	c := &Conf{}
-	if err := yaml.Unmarshal(data, c); err != nil {
+	c, problems, err := decodeConf(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, "\n"))
+	}
+
+	if err := validateConf(c); err != nil {
 		return nil, err
 	}
+	return c, nil
+}
 
-	if c.Addr == "" {
-		return nil, errors.New("address config is required")
+// validateConf checks the settings of a decoded config and fills in defaults.
+func validateConf(c *Conf) error {
+	if _, err := listenerConfs(c); err != nil {
+		return err
 	}
 
 	if c.Auth.Session.Key == "" {
-		return nil, errors.New("auth.session.key config is required")
+		return errors.New("auth.session.key config is required")
 	}
 	if c.Auth.Info.Service == "" {
-		return nil, errors.New("auth.info.service config is required")
+		return errors.New("auth.info.service config is required")
 	}
 	if c.Auth.Info.ClientId == "" {
-		return nil, errors.New("auth.info.client_id config is required")
+		return errors.New("auth.info.client_id config is required")
 	}
 	if c.Auth.Info.ClientSecret == "" {
-		return nil, errors.New("auth.info.client_secret config is required")
+		return errors.New("auth.info.client_secret config is required")
 	}
 	if c.Auth.Info.RedirectURL == "" {
-		return nil, errors.New("auth.info.redirect_url config is required")
+		return errors.New("auth.info.redirect_url config is required")
 	}
 
 	if c.Htdocs == "" {
 		c.Htdocs = "."
 	}
 
+	if c.Admin.Path != "" && !strings.HasPrefix(c.Admin.Path, "/") {
+		return errors.New("admin.path must start with /")
+	}
+	c.Admin.Path = strings.TrimSuffix(c.Admin.Path, "/")
+
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		return err
+	}
+
+	if _, err := newHeaderRules(c.RequestHeaders); err != nil {
+		return fmt.Errorf("request_headers: %s", err)
+	}
+	if _, err := newRateLimiter("global", c.RateLimit); err != nil {
+		return err
+	}
+	if _, err := parseSize("max_body_size", c.MaxBodySize); err != nil {
+		return err
+	}
+	if _, err := newServer(c, nil); err != nil {
+		return fmt.Errorf("server: %s", err)
+	}
+	if _, err := shutdownTimeout(c.Server); err != nil {
+		return fmt.Errorf("server: %s", err)
+	}
+	if _, err := parseDuration("reload.interval", c.Reload.Interval); err != nil {
+		return err
+	}
+	if _, err := newHeaderRules(c.ResponseHeaders); err != nil {
+		return fmt.Errorf("response_headers: %s", err)
+	}
+
+	for i := range c.Proxies {
+		p := &c.Proxies[i]
+		if _, _, _, err := parseDest(p.Dest); err != nil {
+			return fmt.Errorf("proxy %s: %s", p.Path, c.destError(i, err))
+		}
+		if p.RewriteBody && len(p.RewriteTypes) == 0 {
+			p.RewriteTypes = defaultRewriteTypes
+		}
+		if _, err := newHeaderRules(p.RequestHeaders); err != nil {
+			return fmt.Errorf("proxy %s: request_headers: %s", p.Path, err)
+		}
+		if _, err := newHeaderRules(p.ResponseHeaders); err != nil {
+			return fmt.Errorf("proxy %s: response_headers: %s", p.Path, err)
+		}
+		if _, err := newUpstreamCredentials(p.UpstreamAuth); err != nil {
+			return fmt.Errorf("proxy %s: %s", p.Path, err)
+		}
+		if p.HostHeader == "" {
+			p.HostHeader = HostHeaderPreserve
+		}
+		if strings.ContainsAny(p.HostHeader, " \t\r\n/") {
+			return fmt.Errorf("proxy %s: invalid host_header: %q", p.Path, p.HostHeader)
+		}
+		if _, err := newWebsocketOptions(p.WebSocket); err != nil {
+			return fmt.Errorf("proxy %s: %s", p.Path, err)
+		}
+		if _, err := newUpstreamTLSConfig(p.TLS); err != nil {
+			return fmt.Errorf("proxy %s: %s", p.Path, err)
+		}
+		if _, err := newUpstreamOptions(*p); err != nil {
+			return fmt.Errorf("proxy %s: %s", p.Path, err)
+		}
+		if _, err := newCircuitBreaker(p.Path, p.CircuitBreaker); err != nil {
+			return fmt.Errorf("proxy %s: %s", p.Path, err)
+		}
+		if _, err := parseFlushInterval(p.FlushInterval); err != nil {
+			return fmt.Errorf("proxy %s: %s", p.Path, err)
+		}
+		if _, err := newRateLimiter(p.Path, p.RateLimit); err != nil {
+			return fmt.Errorf("proxy %s: %s", p.Path, err)
+		}
+		if _, err := parseSize("max_body_size", p.MaxBodySize); err != nil {
+			return fmt.Errorf("proxy %s: %s", p.Path, err)
+		}
+		switch p.ClientCert {
+		case "", ClientCertAlternative, ClientCertRequired:
+		default:
+			return fmt.Errorf("proxy %s: invalid client_cert: %s (must be %s or %s)", p.Path, p.ClientCert, ClientCertAlternative, ClientCertRequired)
+		}
+		if p.ClientCert != "" && c.SSL.ClientCA == "" {
+			return fmt.Errorf("proxy %s: ssl.client_ca is required for client_cert", p.Path)
+		}
+	}
+
+	if _, err := newACMEManager(c); err != nil {
+		return err
+	}
+	if _, err := newCertificateStore(c.SSL); err != nil {
+		return err
+	}
+	if err := configureServerTLS(&tls.Config{}, c.SSL); err != nil {
+		return err
+	}
+	if _, err := newHSTSHeader(c.SSL.HSTS); err != nil {
+		return err
+	}
+	if _, err := newClientCertPolicy(c.SSL); err != nil {
+		return err
+	}
+
 	if c.Auth.Info.Service == "github" && c.Auth.Info.Endpoint == "" {
 		c.Auth.Info.Endpoint = "https://github.com"
 	}
@@ -101,7 +387,31 @@ func ParseConf(path string) (*Conf, error) {
 		c.Auth.Info.ApiEndpoint = "https://api.github.com"
 	}
 
-	return c, nil
+	return nil
+}
+
+// parseDuration parses a duration config value. An empty value is zero.
+func parseDuration(name, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", name, value)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%s must not be negative", name)
+	}
+	return d, nil
+}
+
+// parseFlushInterval parses flush_interval. "immediate" (or -1) flushes
+// after every write.
+func parseFlushInterval(value string) (time.Duration, error) {
+	if value == "immediate" || value == "-1" {
+		return -1, nil
+	}
+	return parseDuration("flush_interval", value)
 }
 
 func (c *Conf) SetOAuth2Paths() {
@@ -2,7 +2,9 @@ package main
 
 import (
 	"io/ioutil"
+	"net/http"
 	"os"
+	"strings"
 	"testing"
 	"github.com/martini-contrib/oauth2"
 )
@@ -257,3 +259,75 @@ paths:
 		t.Errorf("unexpected oauth2.PathError: %s", oauth2.PathError)
 	}
 }
+
+func TestParseHeaders(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Error(err)
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	data := `---
+address: ":9999"
+
+auth:
+  session:
+    key: secret
+
+  info:
+    service: 'google'
+    client_id: 'secret client id'
+    client_secret: 'secret client secret'
+    redirect_url: 'http://example.com/oauth2callback'
+
+response_headers:
+  delete:
+    - Server
+    - X-Powered-By
+
+proxy:
+  - path: /foo
+    dest: http://example.com/bar
+    request_headers:
+      set:
+        X-Remote-User: '{{.User.Email}}'
+      add:
+        X-Client-IP: '{{.ClientIP}}'
+`
+	if err := ioutil.WriteFile(f.Name(), []byte(data), 0644); err != nil {
+		t.Error(err)
+	}
+
+	conf, err := ParseConf(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(conf.ResponseHeaders.Delete) != 2 {
+		t.Errorf("unexpected response_headers: %#v", conf.ResponseHeaders)
+	}
+	if conf.Proxies[0].RequestHeaders.Set["X-Remote-User"] != "{{.User.Email}}" {
+		t.Errorf("unexpected request_headers: %#v", conf.Proxies[0].RequestHeaders)
+	}
+
+	rules, err := newHeaderRules(conf.Proxies[0].RequestHeaders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := http.Header{}
+	rules.apply(h, &requestInfo{User: User{Email: "foo@example.com"}, ClientIP: "192.0.2.1"})
+	if h.Get("X-Remote-User") != "foo@example.com" || h.Get("X-Client-IP") != "192.0.2.1" {
+		t.Errorf("unexpected headers: %v", h)
+	}
+
+	broken := strings.Replace(data, "{{.ClientIP}}", "{{.ClientIP", 1)
+	if err := ioutil.WriteFile(f.Name(), []byte(broken), 0644); err != nil {
+		t.Error(err)
+	}
+	if _, err := ParseConf(f.Name()); err == nil {
+		t.Errorf("broken header template should be an error")
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// forwardedHeaders are accepted from trusted proxies only.
+var forwardedHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Host",
+	"X-Forwarded-Port",
+	"X-Real-IP",
+}
+
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %s", p)
+			}
+			if ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %s", p)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// forwardedHandler decides who the client is. Forwarded headers sent by
+// trusted proxies are kept and used to find the client IP, while those sent
+// by anyone else are dropped. The client IP is put into X-Real-IP, which is
+// also what martini logs.
+type forwardedHandler struct {
+	trusted []*net.IPNet
+	handler http.Handler
+}
+
+func newForwardedHandler(trusted []*net.IPNet, handler http.Handler) http.Handler {
+	return &forwardedHandler{trusted, handler}
+}
+
+func (h *forwardedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ip := remoteIP(r)
+	if h.isTrusted(ip) {
+		ip = h.forwardedClientIP(r, ip)
+	} else {
+		for _, name := range forwardedHeaders {
+			r.Header.Del(name)
+		}
+	}
+	r.Header.Set("X-Real-IP", ip)
+
+	h.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey, ip)))
+}
+
+func (h *forwardedHandler) isTrusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range h.trusted {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClientIP walks X-Forwarded-For (or Forwarded) from the right and
+// returns the first address which isn't a trusted proxy.
+func (h *forwardedHandler) forwardedClientIP(r *http.Request, peer string) string {
+	var hops []string
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		for _, v := range xff {
+			for _, hop := range strings.Split(v, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+	} else {
+		for _, v := range r.Header.Values("Forwarded") {
+			for _, elem := range strings.Split(v, ",") {
+				if f := forwardedParam(elem, "for"); f != "" {
+					hops = append(hops, f)
+				}
+			}
+		}
+	}
+
+	ip := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := stripPort(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !h.isTrusted(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// forwardedParam returns the value of a parameter of a Forwarded element.
+func forwardedParam(elem, name string) string {
+	for _, pair := range strings.Split(elem, ";") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], name) {
+			return strings.Trim(kv[1], `"`)
+		}
+	}
+	return ""
+}
+
+func stripPort(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return strings.Trim(hostport, "[]")
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientIP returns the client IP resolved by forwardedHandler, or the peer
+// address if the request didn't go through it.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey).(string); ok {
+		return ip
+	}
+	return remoteIP(r)
+}
+
+// setForwardedHeaders adds X-Forwarded-Proto, -Host, -Port and a Forwarded
+// element describing the original request. Values already set by a trusted
+// proxy are kept. X-Forwarded-For is appended by httputil.ReverseProxy.
+func setForwardedHeaders(req *http.Request, info *requestInfo) {
+	_, port, err := net.SplitHostPort(info.Host)
+	if err != nil {
+		port = "80"
+		if info.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		req.Header.Set("X-Forwarded-Proto", info.Scheme)
+	}
+	if req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", info.Host)
+	}
+	if req.Header.Get("X-Forwarded-Port") == "" {
+		req.Header.Set("X-Forwarded-Port", port)
+	}
+
+	elem := fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedNode(remoteIP(req)), quoteForwarded(info.Host), info.Scheme)
+	if prior := req.Header.Values("Forwarded"); len(prior) > 0 {
+		elem = strings.Join(prior, ", ") + ", " + elem
+	}
+	req.Header.Set("Forwarded", elem)
+}
+
+// appendForwardedFor does what httputil.ReverseProxy does for normal
+// requests, for requests written to the backend by hand.
+func appendForwardedFor(req *http.Request) {
+	ip := remoteIP(req)
+	if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		ip = strings.Join(prior, ", ") + ", " + ip
+	}
+	req.Header.Set("X-Forwarded-For", ip)
+}
+
+// forwardedNode formats an IP as a node of the Forwarded header (RFC 7239);
+// IPv6 addresses have to be bracketed and quoted.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+func quoteForwarded(v string) string {
+	if strings.ContainsAny(v, ":[]") {
+		return `"` + v + `"`
+	}
+	return v
+}
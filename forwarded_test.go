@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedHandler(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got *http.Request
+	h := newForwardedHandler(trusted, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+
+	tests := []struct {
+		remote  string
+		xff     string
+		client  string
+		keepXFF bool
+	}{
+		// untrusted peer: forwarded headers are dropped
+		{"203.0.113.5:1234", "198.51.100.1", "203.0.113.5", false},
+		// trusted peer: rightmost untrusted hop is the client
+		{"10.1.2.3:1234", "198.51.100.1, 203.0.113.9, 10.0.0.7", "203.0.113.9", true},
+		{"192.0.2.1:1234", "198.51.100.1", "198.51.100.1", true},
+		// trusted peer without forwarded headers
+		{"10.1.2.3:1234", "", "10.1.2.3", false},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = test.remote
+		if test.xff != "" {
+			req.Header.Set("X-Forwarded-For", test.xff)
+		}
+		req.Header.Set("X-Forwarded-Proto", "https")
+
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		if ip := clientIP(got); ip != test.client {
+			t.Errorf("unexpected client ip for %s (%s): %s", test.remote, test.xff, ip)
+		}
+		if got.Header.Get("X-Real-IP") != test.client {
+			t.Errorf("unexpected X-Real-IP: %s", got.Header.Get("X-Real-IP"))
+		}
+		if test.keepXFF != (got.Header.Get("X-Forwarded-For") != "") {
+			t.Errorf("unexpected X-Forwarded-For for %s: %s", test.remote, got.Header.Get("X-Forwarded-For"))
+		}
+	}
+}
+
+func TestSetForwardedHeaders(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://gate.example.com/foo", nil)
+	req.RemoteAddr = "[2001:db8::1]:5678"
+
+	setForwardedHeaders(req, &requestInfo{Scheme: "https", Host: "gate.example.com"})
+
+	expected := map[string]string{
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "gate.example.com",
+		"X-Forwarded-Port":  "443",
+		"Forwarded":         `for="[2001:db8::1]";host=gate.example.com;proto=https`,
+	}
+	for name, value := range expected {
+		if v := req.Header.Get(name); v != value {
+			t.Errorf("unexpected %s: %s", name, v)
+		}
+	}
+}
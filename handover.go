@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// inheritedListenersEnv names the addresses of the listeners passed to a new
+// process on SIGUSR2, comma separated. Their sockets start at file descriptor
+// 3 in the same order and are followed by the pipe to report readiness on.
+const inheritedListenersEnv = "GATE_LISTENERS"
+
+// handOverTimeout is how long a new process has to start serving.
+const handOverTimeout = time.Minute
+
+// inherited keeps the listeners passed by the previous process.
+var inherited struct {
+	once      sync.Once
+	listeners map[string]net.Listener
+	ready     *os.File
+}
+
+func loadInheritedListeners() {
+	inherited.once.Do(func() {
+		v := os.Getenv(inheritedListenersEnv)
+		if v == "" {
+			return
+		}
+		os.Unsetenv(inheritedListenersEnv)
+
+		addresses := strings.Split(v, ",")
+		listeners, err := fileListeners(sdListenFDsStart, len(addresses))
+		if err != nil {
+			log.Printf("can't use the listeners of the previous process: %s", err)
+			return
+		}
+		inherited.listeners = make(map[string]net.Listener)
+		for i, address := range addresses {
+			inherited.listeners[address] = listeners[i]
+		}
+		inherited.ready = os.NewFile(uintptr(sdListenFDsStart+len(addresses)), "ready")
+	})
+}
+
+// inheritedListener returns the listener for address passed by the previous
+// process, or nil.
+func inheritedListener(address string) net.Listener {
+	loadInheritedListeners()
+	l := inherited.listeners[address]
+	delete(inherited.listeners, address)
+	return l
+}
+
+// notifyReady tells the previous process that this one is serving, and
+// closes the listeners which are no longer configured.
+func notifyReady() {
+	loadInheritedListeners()
+	for address, l := range inherited.listeners {
+		log.Printf("closing listener %s which is no longer configured", address)
+		l.Close()
+		delete(inherited.listeners, address)
+	}
+	if inherited.ready != nil {
+		inherited.ready.Write([]byte{1})
+		inherited.ready.Close()
+		inherited.ready = nil
+	}
+}
+
+// handOver starts a new gate process with the same arguments, passing the
+// listening sockets, and returns its pid once it's serving.
+func handOver(confs []ListenerConf, listeners []net.Listener) (int, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	addresses := make([]string, len(confs))
+	for i, l := range listeners {
+		fl, ok := l.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			return 0, fmt.Errorf("listener %s can't be passed on", confs[i].Address)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return 0, err
+		}
+		files = append(files, f)
+		addresses[i] = confs[i].Address
+	}
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ready.Close()
+	files = append(files, readyW)
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), inheritedListenersEnv+"="+strings.Join(addresses, ","))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	// only the new process may keep the pipe open, so its exit ends the read
+	readyW.Close()
+	files = files[:len(files)-1]
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	ready.SetReadDeadline(time.Now().Add(handOverTimeout))
+	if n, _ := ready.Read(make([]byte, 1)); n != 1 {
+		// still starting after handOverTimeout, or failed
+		cmd.Process.Kill()
+		return 0, fmt.Errorf("the new process didn't start serving: %v", <-exited)
+	}
+
+	// the new process uses the Unix domain sockets now
+	for _, l := range listeners {
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return cmd.Process.Pid, nil
+}
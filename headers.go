@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"sort"
+	"text/template"
+)
+
+type contextKey int
+
+const (
+	requestInfoKey contextKey = iota
+	clientIPKey
+)
+
+// requestInfo describes the original client request. It's the data passed to
+// header value templates, e.g. "{{.User.Email}}" or "{{.ClientIP}}".
+type requestInfo struct {
+	User     User
+	ClientIP string
+	Scheme   string
+	Host     string
+	Method   string
+	Path     string
+	Query    string
+	Header   http.Header
+}
+
+func newRequestInfo(r *http.Request, user *User) *requestInfo {
+	info := &requestInfo{
+		ClientIP: clientIP(r),
+		Scheme:   "http",
+		Host:     r.Host,
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Query:    r.URL.RawQuery,
+		Header:   r.Header.Clone(),
+	}
+	if r.TLS != nil {
+		info.Scheme = "https"
+	}
+	if user != nil {
+		info.User = *user
+	}
+	return info
+}
+
+// withRequestInfo returns a shallow copy of r carrying the requestInfo for
+// the original request, so it's still available after the director rewrote
+// the request for the backend.
+func withRequestInfo(r *http.Request, user *User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey, newRequestInfo(r, user)))
+}
+
+func requestInfoFrom(r *http.Request) *requestInfo {
+	if info, ok := r.Context().Value(requestInfoKey).(*requestInfo); ok {
+		return info
+	}
+	return newRequestInfo(r, nil)
+}
+
+var headerTemplateFuncs = template.FuncMap{
+	"base64": func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	},
+}
+
+type headerRule struct {
+	name  string
+	value *template.Template
+}
+
+// headerRules is the compiled form of a HeaderConf. Deletes are applied
+// first, then sets and finally adds.
+type headerRules struct {
+	set    []headerRule
+	add    []headerRule
+	delete []string
+}
+
+func newHeaderRules(c HeaderConf) (*headerRules, error) {
+	set, err := compileHeaderRules(c.Set)
+	if err != nil {
+		return nil, err
+	}
+	add, err := compileHeaderRules(c.Add)
+	if err != nil {
+		return nil, err
+	}
+
+	return &headerRules{set: set, add: add, delete: c.Delete}, nil
+}
+
+func compileHeaderRules(headers map[string]string) ([]headerRule, error) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rules := make([]headerRule, 0, len(names))
+	for _, name := range names {
+		t, err := template.New(name).Funcs(headerTemplateFuncs).Option("missingkey=zero").Parse(headers[name])
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, headerRule{http.CanonicalHeaderKey(name), t})
+	}
+	return rules, nil
+}
+
+func (h *headerRules) empty() bool {
+	return len(h.set) == 0 && len(h.add) == 0 && len(h.delete) == 0
+}
+
+func (h *headerRules) apply(header http.Header, info *requestInfo) {
+	for _, name := range h.delete {
+		header.Del(name)
+	}
+	for _, r := range h.set {
+		if v, ok := r.execute(info); ok {
+			header.Set(r.name, v)
+		}
+	}
+	for _, r := range h.add {
+		if v, ok := r.execute(info); ok {
+			header.Add(r.name, v)
+		}
+	}
+}
+
+func (r headerRule) execute(info *requestInfo) (string, bool) {
+	var buf bytes.Buffer
+	if err := r.value.Execute(&buf, info); err != nil {
+		log.Printf("failed to render value of header %s: %s", r.name, err)
+		return "", false
+	}
+	return buf.String(), true
+}
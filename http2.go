@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	defaultTLSHandshakeTimeout = 10 * time.Second
+	http2ReadIdleTimeout       = 30 * time.Second
+)
+
+// checkHTTP2Options rejects settings which don't apply to HTTP/2 backends.
+func checkHTTP2Options(o upstreamOptions, dest string) error {
+	u, socket, _, err := parseDest(dest)
+	if err != nil {
+		return err
+	}
+	switch {
+	case o.protocol == ProtocolH2 && (socket != "" || u.Scheme != "https"):
+		return errors.New("protocol h2 needs an https dest, use h2c for plain text")
+	case o.protocol == ProtocolH2C && u.Scheme != "http":
+		return errors.New("protocol h2c needs an http or unix dest, use h2 for https")
+	case o.responseHeaderTimeout > 0:
+		return fmt.Errorf("timeouts.response_header is not supported with protocol %s", o.protocol)
+	case o.maxIdleConnsPerHost > 0 || o.maxConnsPerHost > 0:
+		return fmt.Errorf("pool is not supported with protocol %s, requests share a connection", o.protocol)
+	}
+	return nil
+}
+
+// newHTTP2Transport returns a transport speaking HTTP/2 only, over TLS (h2)
+// or in plain text (h2c). Trailers, as used by gRPC, are passed on by
+// ReverseProxy.
+func (b *Backend) newHTTP2Transport(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *http2.Transport {
+	o := b.Upstream
+	handshakeTimeout := o.tlsHandshakeTimeout
+	if handshakeTimeout == 0 {
+		handshakeTimeout = defaultTLSHandshakeTimeout
+	}
+
+	return &http2.Transport{
+		TLSClientConfig: b.TLSConfig,
+		AllowHTTP:       o.protocol == ProtocolH2C,
+		// detect dead connections below long running streams
+		ReadIdleTimeout: http2ReadIdleTimeout,
+		DialTLSContext: func(ctx context.Context, network, addr string, config *tls.Config) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil || o.protocol == ProtocolH2C {
+				return conn, err
+			}
+
+			ctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+			defer cancel()
+			tlsConn := tls.Client(conn, config)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			if p := tlsConn.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+				conn.Close()
+				return nil, fmt.Errorf("backend %s does not support HTTP/2 (negotiated %q)", addr, p)
+			}
+			return tlsConn, nil
+		},
+	}
+}
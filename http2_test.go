@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// grpcLikeHandler answers like a gRPC server: HTTP/2 only, with the status in
+// undeclared trailers.
+func grpcLikeHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("backend got %s", r.Proto)
+		}
+		if r.Header.Get("Te") != "trailers" {
+			t.Errorf("TE header not passed: %v", r.Header)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write(body)
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+	}
+}
+
+func newTestHTTP2Proxy(t *testing.T, dest string, protocol string, tlsConfig *tls.Config) *httptest.Server {
+	u, err := url.Parse(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := newUpstreamOptions(ProxyConf{Dest: dest, Protocol: protocol})
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewUnstartedServer(newVirtualHostReverseProxy([]Backend{{URL: u, Upstream: upstream, TLSConfig: tlsConfig}}))
+	front.EnableHTTP2 = true
+	front.StartTLS()
+	return front
+}
+
+func postGRPC(t *testing.T, front *httptest.Server) *http.Response {
+	req, _ := http.NewRequest("POST", front.URL+"/helloworld.Greeter/SayHello", strings.NewReader("\x00\x00\x00\x00\x00"))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	res, err := front.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func checkGRPCResponse(t *testing.T, res *http.Response) {
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %s", res.Status)
+	}
+	if res.ProtoMajor != 2 {
+		t.Errorf("front served %s", res.Proto)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "\x00\x00\x00\x00\x00" {
+		t.Errorf("unexpected body: %q", body)
+	}
+	if res.Trailer.Get("Grpc-Status") != "0" || res.Trailer.Get("Grpc-Message") != "ok" {
+		t.Errorf("trailers not passed through: %v", res.Trailer)
+	}
+}
+
+func TestHTTP2ProxyH2C(t *testing.T) {
+	backend := httptest.NewServer(h2c.NewHandler(grpcLikeHandler(t), &http2.Server{}))
+	defer backend.Close()
+
+	front := newTestHTTP2Proxy(t, backend.URL, ProtocolH2C, nil)
+	defer front.Close()
+
+	checkGRPCResponse(t, postGRPC(t, front))
+}
+
+func TestHTTP2ProxyH2(t *testing.T) {
+	backend := httptest.NewUnstartedServer(grpcLikeHandler(t))
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(backend.Certificate())
+	front := newTestHTTP2Proxy(t, backend.URL, ProtocolH2, &tls.Config{RootCAs: pool})
+	defer front.Close()
+
+	checkGRPCResponse(t, postGRPC(t, front))
+}
+
+func TestHTTP2ProxyBackendWithoutHTTP2(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "HTTP/1.1 only\n")
+	}))
+	defer backend.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(backend.Certificate())
+	front := newTestHTTP2Proxy(t, backend.URL, ProtocolH2, &tls.Config{RootCAs: pool})
+	defer front.Close()
+
+	res := postGRPC(t, front)
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusBadGateway {
+		t.Errorf("unexpected status: %s", res.Status)
+	}
+}
+
+func TestHTTP2Options(t *testing.T) {
+	tests := []struct {
+		conf ProxyConf
+		ok   bool
+	}{
+		{ProxyConf{Dest: "https://127.0.0.1:50051", Protocol: ProtocolH2}, true},
+		{ProxyConf{Dest: "http://127.0.0.1:50051", Protocol: ProtocolH2C}, true},
+		{ProxyConf{Dest: "unix:///run/grpc.sock", Protocol: ProtocolH2C}, true},
+		{ProxyConf{Dest: "http://127.0.0.1:8080", Protocol: ProtocolHTTP1}, true},
+		{ProxyConf{Dest: "http://127.0.0.1:50051", Protocol: ProtocolH2}, false},
+		{ProxyConf{Dest: "https://127.0.0.1:50051", Protocol: ProtocolH2C}, false},
+		{ProxyConf{Dest: "http://127.0.0.1:50051", Protocol: "spdy"}, false},
+		{ProxyConf{Dest: "http://127.0.0.1:50051", Protocol: ProtocolH2C, Timeouts: TimeoutConf{ResponseHeader: "1s"}}, false},
+		{ProxyConf{Dest: "http://127.0.0.1:50051", Protocol: ProtocolH2C, Pool: PoolConf{MaxConnsPerHost: 4}}, false},
+	}
+	for i, test := range tests {
+		_, err := newUpstreamOptions(test.conf)
+		if (err == nil) != test.ok {
+			t.Errorf("test %d: unexpected result: %v", i, err)
+		}
+	}
+}
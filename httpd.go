@@ -1,15 +1,19 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/base64"
-	"io"
+	"expvar"
+	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"time"
 
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/oauth2"
@@ -18,17 +22,52 @@ import (
 
 type Server struct {
 	Conf *Conf
+	// ConfFile is read again on reload.
+	ConfFile string
+
+	handler     *reloadableHandler
+	sessionKeys []string    // the current one first
+	state       *proxyState // of the current handler
 }
 
 type User struct {
 	Email string
+	Login string
+
+	// from a client certificate
+	CommonName string
+	SPIFFEID   string
 }
 
 type Backend struct {
-	Host      string
-	URL       *url.URL
-	Strip     bool
-	StripPath string
+	Dest         string
+	Host         string
+	URL          *url.URL
+	Strip        bool
+	StripPath    string
+	RewriteBody  bool
+	RewriteTypes []string
+
+	RequestHeaders  []*headerRules
+	ResponseHeaders []*headerRules
+	Credentials     *upstreamCredentials
+	HostHeader      string
+	WebSocket       websocketOptions
+	TLSConfig       *tls.Config
+	Upstream        upstreamOptions
+	Breaker         *circuitBreaker
+	FlushInterval   time.Duration
+	RateLimiters    []*rateLimiter
+	MaxBodySize     int64
+	ClientCert      string
+
+	// Socket is the path of the Unix domain socket for unix:// dests.
+	// PathPrefix is prepended to request paths for them.
+	Socket     string
+	PathPrefix string
+
+	proxy *httputil.ReverseProxy
+	next  uint32 // requests balanced over the members
 }
 
 const (
@@ -36,18 +75,28 @@ const (
 )
 
 func NewServer(conf *Conf) *Server {
-	return &Server{conf}
+	return &Server{Conf: conf, sessionKeys: []string{conf.Auth.Session.Key}}
 }
 
-func (s *Server) Run() error {
+// newHandler builds the routing table, authentication and restrictions of
+// the current config.
+func (s *Server) newHandler() (http.Handler, error) {
 	m := martini.Classic()
 
-	cookieStore := sessions.NewCookieStore([]byte(s.Conf.Auth.Session.Key))
+	cookieStore := sessions.NewCookieStore(s.sessionKeyPairs()...)
 	if domain := s.Conf.Auth.Session.CookieDomain; domain != "" {
 		cookieStore.Options(sessions.Options{Domain: domain})
 	}
 	m.Use(sessions.Sessions("session", cookieStore))
 
+	clientCerts, err := newClientCertPolicy(s.Conf.SSL)
+	if err != nil {
+		return nil, err
+	}
+	if clientCerts != nil {
+		m.Use(clientCerts.Handler())
+	}
+
 	if s.Conf.Auth.Info.Service != noAuthServiceName {
 		a := NewAuthenticator(s.Conf)
 		m.Use(a.Handler())
@@ -55,6 +104,28 @@ func (s *Server) Run() error {
 		m.Use(restrictRequest(s.Conf.Restrictions, a))
 	}
 
+	globalRequestHeaders, err := newHeaderRules(s.Conf.RequestHeaders)
+	if err != nil {
+		return nil, err
+	}
+	globalResponseHeaders, err := newHeaderRules(s.Conf.ResponseHeaders)
+	if err != nil {
+		return nil, err
+	}
+	prev := s.state
+	if prev == nil {
+		prev = newProxyState()
+	}
+	state := newProxyState()
+	globalRateLimiter, err := state.rateLimiter(prev, "global", s.Conf.RateLimit)
+	if err != nil {
+		return nil, err
+	}
+	globalMaxBodySize, err := parseSize("max_body_size", s.Conf.MaxBodySize)
+	if err != nil {
+		return nil, err
+	}
+
 	backendsFor := make(map[string][]Backend)
 	backendIndex := make([]string, len(s.Conf.Proxies))
 	rawPaths := make([]string, len(s.Conf.Proxies))
@@ -62,39 +133,107 @@ func (s *Server) Run() error {
 	for i := range s.Conf.Proxies {
 		p := s.Conf.Proxies[i]
 
-		rawPath := ""
-		if strings.HasSuffix(p.Path, "/") == false {
-			rawPath = p.Path
-			p.Path += "/"
-		}
-		strip_path := p.Path
+		var strip_path, rawPath string
+		p.Path, strip_path, rawPath = routePaths(p.Path)
 
-		if strings.HasSuffix(p.Path, "**") == false {
-			p.Path += "**"
+		u, socket, prefix, err := parseDest(p.Dest)
+		if err != nil {
+			return nil, err
 		}
-
-		u, err := url.Parse(p.Dest)
+		requestHeaders, err := newHeaderRules(p.RequestHeaders)
+		if err != nil {
+			return nil, err
+		}
+		responseHeaders, err := newHeaderRules(p.ResponseHeaders)
+		if err != nil {
+			return nil, err
+		}
+		credentials, err := newUpstreamCredentials(p.UpstreamAuth)
+		if err != nil {
+			return nil, err
+		}
+		websocket, err := newWebsocketOptions(p.WebSocket)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig, err := newUpstreamTLSConfig(p.TLS)
+		if err != nil {
+			return nil, err
+		}
+		upstream, err := newUpstreamOptions(p)
+		if err != nil {
+			return nil, err
+		}
+		breaker, err := state.breaker(prev, p.Host+strip_path, p.CircuitBreaker)
+		if err != nil {
+			return nil, err
+		}
+		flushInterval, err := parseFlushInterval(p.FlushInterval)
+		if err != nil {
+			return nil, err
+		}
+		rateLimiter, err := state.rateLimiter(prev, p.Host+strip_path, p.RateLimit)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		maxBodySize, err := parseSize("max_body_size", p.MaxBodySize)
+		if err != nil {
+			return nil, err
+		}
+		if maxBodySize == 0 {
+			maxBodySize = globalMaxBodySize
+		}
+		if p.TLS.InsecureSkipVerify {
+			log.Printf("WARNING: certificate verification for %s is DISABLED (insecure_skip_verify). Connections to it can be intercepted!", redactedDest(p.Dest))
 		}
 		backendsFor[p.Path] = append(backendsFor[p.Path], Backend{
-			Host:      p.Host,
-			URL:       u,
-			Strip:     p.Strip,
-			StripPath: strip_path,
+			Dest:            redactedDest(p.Dest),
+			Host:            p.Host,
+			URL:             u,
+			Strip:           p.Strip,
+			StripPath:       strip_path,
+			RewriteBody:     p.RewriteBody,
+			RewriteTypes:    p.RewriteTypes,
+			RequestHeaders:  nonEmptyHeaderRules(globalRequestHeaders, requestHeaders),
+			ResponseHeaders: nonEmptyHeaderRules(globalResponseHeaders, responseHeaders),
+			Credentials:     credentials,
+			HostHeader:      p.HostHeader,
+			WebSocket:       websocket,
+			TLSConfig:       tlsConfig,
+			Upstream:        upstream,
+			Breaker:         breaker,
+			FlushInterval:   flushInterval,
+			RateLimiters:    nonNilRateLimiters(globalRateLimiter, rateLimiter),
+			MaxBodySize:     maxBodySize,
+			ClientCert:      p.ClientCert,
+			Socket:          socket,
+			PathPrefix:      prefix,
 		})
 		backendIndex[i] = p.Path
 		rawPaths[i] = rawPath
-		log.Printf("register proxy host:%s path:%s dest:%s strip_path:%v", p.Host, strip_path, u.String(), p.Strip)
+		log.Printf("register proxy host:%s path:%s dest:%s strip_path:%v host_header:%s", p.Host, strip_path, u.Redacted(), p.Strip, p.HostHeader)
 	}
 
+	if s.Conf.Admin.Path != "" {
+		log.Printf("admin endpoint at %s", s.Conf.Admin.Path)
+		m.Get(s.Conf.Admin.Path+"/vars", expvar.Handler().ServeHTTP)
+		m.Get(s.Conf.Admin.Path+"/backends", adminBackendsHandler)
+	}
+
+	var backends []*Backend
 	registered := make(map[string]bool)
 	for i, path := range backendIndex {
 		if registered[path] {
 			continue
 		}
 		proxy := newVirtualHostReverseProxy(backendsFor[path])
+		for j := range backendsFor[path] {
+			backends = append(backends, &backendsFor[path][j])
+		}
 		m.Any(path, proxyHandleWrapper(proxy))
+		if clientCerts != nil {
+			clientCerts.addRoute(strings.TrimSuffix(path, "**"), proxy)
+		}
 		registered[path] = true
 		rawPath := rawPaths[i]
 		if rawPath != "" {
@@ -106,115 +245,241 @@ func (s *Server) Run() error {
 
 	path, err := filepath.Abs(s.Conf.Htdocs)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	log.Printf("starting static file server for: %s", path)
 	fileServer := http.FileServer(http.Dir(path))
 	m.Get("/**", fileServer.ServeHTTP)
 
-	log.Printf("starting server at %s", s.Conf.Addr)
+	trusted, err := parseTrustedProxies(s.Conf.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
 
-	if s.Conf.SSL.Cert != "" && s.Conf.SSL.Key != "" {
-		return http.ListenAndServeTLS(s.Conf.Addr, s.Conf.SSL.Cert, s.Conf.SSL.Key, m)
-	} else {
-		return http.ListenAndServe(s.Conf.Addr, m)
+	// nothing can fail anymore, the handler is going to be used
+	s.state = state
+	registerBackends(backends)
+	return newForwardedHandler(trusted, m), nil
+}
+
+func (s *Server) Run() error {
+	handler, err := s.newHandler()
+	if err != nil {
+		return err
 	}
+	s.handler = &reloadableHandler{}
+	s.handler.set(handler)
+
+	return s.serve(s.handler)
 }
 
-func newVirtualHostReverseProxy(backends []Backend) http.Handler {
-	bmap := make(map[string]Backend)
-	for _, b := range backends {
-		bmap[b.Host] = b
+type virtualHostProxy struct {
+	backends       map[string]*Backend
+	defaultBackend *Backend
+}
+
+func newVirtualHostReverseProxy(backends []Backend) *virtualHostProxy {
+	p := &virtualHostProxy{backends: make(map[string]*Backend)}
+	for i := range backends {
+		b := &backends[i]
+		b.proxy = newBackendReverseProxy(b)
+		p.backends[b.Host] = b
 	}
-	defaultBackend, ok := bmap[""]
+	defaultBackend, ok := p.backends[""]
 	if !ok {
-		defaultBackend = backends[0]
+		defaultBackend = &backends[0]
 	}
+	p.defaultBackend = defaultBackend
+
+	return p
+}
 
-	director := func(req *http.Request) {
-		b, ok := bmap[req.Host]
-		if !ok {
-			b = defaultBackend
+func (p *virtualHostProxy) backendFor(req *http.Request) *Backend {
+	if b, ok := p.backends[req.Host]; ok {
+		return b
+	}
+	return p.defaultBackend
+}
+
+func (p *virtualHostProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b := p.backendFor(r)
+	if !b.allowRequest(w, r) {
+		return
+	}
+	if isWebsocket(r) {
+		b.serveWebsocket(w, r)
+	} else {
+		b.serveHTTP(w, r)
+	}
+}
+
+func newBackendReverseProxy(b *Backend) *httputil.ReverseProxy {
+	// Besides FlushInterval, ReverseProxy flushes text/event-stream responses
+	// and responses of unknown length (chunked ones) after every write.
+	return &httputil.ReverseProxy{
+		Director:       b.director,
+		Transport:      b.newTransport(),
+		FlushInterval:  b.FlushInterval,
+		ModifyResponse: b.modifyResponse,
+		ErrorHandler:   b.errorHandler,
+	}
+}
+
+func (b *Backend) name() string {
+	return b.Host + b.StripPath
+}
+
+func (b *Backend) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if !b.limitBody(w, r) {
+		return
+	}
+	if b.Upstream.overallTimeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), b.Upstream.overallTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	b.proxy.ServeHTTP(w, r)
+}
+
+// parseDest parses the dest of a proxy definition. Besides http and https
+// URLs, Unix domain sockets are supported as "unix:///path/to.sock",
+// optionally followed by a path prefix: "unix:///path/to.sock:/prefix".
+func parseDest(dest string) (u *url.URL, socket string, prefix string, err error) {
+	if !strings.HasPrefix(dest, "unix://") {
+		u, err = url.Parse(dest)
+		return u, "", "", err
+	}
+
+	socket = strings.TrimPrefix(dest, "unix://")
+	if i := strings.Index(socket, ":"); i >= 0 {
+		socket, prefix = socket[:i], socket[i+1:]
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, "", "", fmt.Errorf("invalid path in dest %s: %s", dest, prefix)
 		}
-		req.URL.Scheme = b.URL.Scheme
-		req.URL.Host = b.URL.Host
-		if b.Strip {
-			if p := strings.TrimPrefix(req.URL.Path, b.StripPath); len(p) < len(req.URL.Path) {
-				req.URL.Path = "/" + p
-			}
+		prefix = strings.TrimSuffix(prefix, "/")
+	}
+	if socket == "" {
+		return nil, "", "", fmt.Errorf("socket path is missing in dest %s", dest)
+	}
+
+	// requests still need a host; it's not used to connect
+	return &url.URL{Scheme: "http", Host: "localhost"}, socket, prefix, nil
+}
+
+// routePaths returns the route pattern for the path of a proxy, the prefix
+// removed by strip_path and, if path has no trailing slash, path itself,
+// which is redirected to the prefix.
+func routePaths(path string) (pattern, prefix, rawPath string) {
+	if strings.HasSuffix(path, "/") == false {
+		rawPath = path
+		path += "/"
+	}
+	prefix = path
+
+	if strings.HasSuffix(path, "**") == false {
+		path += "**"
+	}
+	return path, prefix, rawPath
+}
+
+// rewriteURL points u to the backend.
+func (b *Backend) rewriteURL(u *url.URL) {
+	u.Scheme = b.URL.Scheme
+	u.Host = b.memberHost()
+	if b.Strip {
+		if p := strings.TrimPrefix(u.Path, b.StripPath); len(p) < len(u.Path) {
+			u.Path = "/" + p
 		}
-		req.Header.Set(BackendHostHeader, req.URL.Host)
-		log.Println("backend url", req.URL.String())
 	}
-	return &httputil.ReverseProxy{Director: director}
+	if b.PathPrefix != "" {
+		u.Path = b.PathPrefix + "/" + strings.TrimPrefix(u.Path, "/")
+		u.RawPath = ""
+	}
 }
 
-func isWebsocket(r *http.Request) bool {
-	if strings.ToLower(r.Header.Get("Connection")) == "upgrade" &&
-		strings.ToLower(r.Header.Get("Upgrade")) == "websocket" {
-		return true
-	} else {
-		return false
-	}
-}
-
-func proxyHandleWrapper(handler http.Handler) http.Handler {
-	proxy, _ := handler.(*httputil.ReverseProxy)
-	director := proxy.Director
-
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// websocket?
-		if isWebsocket(r) {
-			director(r) // rewrite request headers for backend
-			target := r.Header.Get(BackendHostHeader)
-
-			if strings.HasPrefix(r.URL.Path, "/") == false {
-				r.URL.Path = "/" + r.URL.Path
-			}
-
-			log.Printf("proxy ws request: %s", r.URL.String())
-
-			// websocket proxy by bradfitz https://groups.google.com/forum/#!topic/golang-nuts/KBx9pDlvFOc
-			d, err := net.Dial("tcp", target)
-			if err != nil {
-				http.Error(w, "Error contacting backend server.", 500)
-				log.Printf("Error dialing websocket backend %s: %v", target, err)
-				return
-			}
-			hj, ok := w.(http.Hijacker)
-			if !ok {
-				http.Error(w, "Not a hijacker?", 500)
-				return
-			}
-			nc, _, err := hj.Hijack()
-			if err != nil {
-				log.Printf("Hijack error: %v", err)
-				return
-			}
-			defer nc.Close()
-			defer d.Close()
-
-			err = r.Write(d)
-			if err != nil {
-				log.Printf("Error copying request to target: %v", err)
-				return
-			}
-
-			errc := make(chan error, 2)
-			cp := func(dst io.Writer, src io.Reader) {
-				_, err := io.Copy(dst, src)
-				errc <- err
-			}
-			go cp(d, nc)
-			go cp(nc, d)
-			for i := 0; i < cap(errc); i++ {
-				<-errc
-			}
-		} else {
-			handler.ServeHTTP(w, r)
-		}
-	})
+func (b *Backend) director(req *http.Request) {
+	b.rewriteURL(req.URL)
+	req.Header.Set(BackendHostHeader, req.URL.Host)
+
+	info := requestInfoFrom(req)
+
+	switch b.HostHeader {
+	case "", HostHeaderPreserve:
+	case HostHeaderUpstream:
+		req.Host = req.URL.Host
+	default:
+		req.Host = b.HostHeader
+	}
+
+	setForwardedHeaders(req, info)
+	for _, h := range b.RequestHeaders {
+		h.apply(req.Header, info)
+	}
+	if b.Credentials != nil {
+		b.Credentials.apply(req)
+	}
+
+	log.Println("backend url", req.URL.String())
+}
+
+func (b *Backend) modifyResponse(res *http.Response) error {
+	if len(b.ResponseHeaders) > 0 {
+		info := requestInfoFrom(res.Request)
+		for _, h := range b.ResponseHeaders {
+			h.apply(res.Header, info)
+		}
+	}
+	if b.RewriteBody {
+		return b.rewriteResponse(res)
+	}
+	return nil
+}
+
+// nonEmptyHeaderRules drops header rules that have nothing to do. Global rules
+// come first so that per route rules win.
+func nonEmptyHeaderRules(rules ...*headerRules) []*headerRules {
+	var res []*headerRules
+	for _, h := range rules {
+		if !h.empty() {
+			res = append(res, h)
+		}
+	}
+	return res
+}
+
+func proxyHandleWrapper(proxy *virtualHostProxy) martini.Handler {
+	return func(c martini.Context, w http.ResponseWriter, r *http.Request) {
+		proxy.ServeHTTP(w, withRequestInfo(r, userFromContext(c)))
+	}
+}
+
+// mappedUser returns the user logged in by OAuth or, instead of it, by a
+// client certificate.
+func mappedUser(c martini.Context) *User {
+	v := c.Get(reflect.TypeOf((*User)(nil)))
+	if !v.IsValid() {
+		return nil
+	}
+	user, _ := v.Interface().(*User)
+	return user
+}
+
+// userFromContext returns the user of the request for headers and rate
+// limits: the mapped user, with the identity of a client certificate merged
+// into it when one was presented, or nil if the request is anonymous.
+func userFromContext(c martini.Context) *User {
+	user := mappedUser(c)
+	if id := identityFromContext(c); id != nil {
+		// OAuth user with a client certificate as extra factor
+		merged := User{}
+		if user != nil {
+			merged = *user
+		}
+		id.fill(&merged)
+		user = &merged
+	}
+	return user
 }
 
 // base64Decode decodes the Base64url encoded string
@@ -233,8 +498,8 @@ func base64Decode(s string) ([]byte, error) {
 
 func restrictRequest(restrictions []string, authenticator Authenticator) martini.Handler {
 	return func(c martini.Context, tokens oauth2.Tokens, w http.ResponseWriter, r *http.Request) {
-		// skip websocket
-		if isWebsocket(r) {
+		// skip users authenticated by client certificate
+		if mappedUser(c) != nil {
 			return
 		}
 
@@ -244,7 +509,7 @@ func restrictRequest(restrictions []string, authenticator Authenticator) martini
 
 func loginRequired() martini.Handler {
 	return func(s sessions.Session, c martini.Context, w http.ResponseWriter, r *http.Request) {
-		if isWebsocket(r) {
+		if mappedUser(c) != nil {
 			return
 		}
 		c.Invoke(oauth2.LoginRequired)
@@ -3,8 +3,12 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -175,3 +179,81 @@ proxy:
 	}
 
 }
+
+func TestHostHeader(t *testing.T) {
+	u, _ := url.Parse("http://127.0.0.1:9200")
+	tests := map[string]string{
+		"":                       "foo.gate.example.com",
+		HostHeaderPreserve:       "foo.gate.example.com",
+		HostHeaderUpstream:       "127.0.0.1:9200",
+		"elasticsearch.internal": "elasticsearch.internal",
+	}
+	for mode, expected := range tests {
+		b := &Backend{URL: u, HostHeader: mode}
+		req, _ := http.NewRequest("GET", "http://foo.gate.example.com/", nil)
+		b.director(req)
+		if req.Host != expected {
+			t.Errorf("unexpected host for mode %q: %s", mode, req.Host)
+		}
+		if req.URL.Host != "127.0.0.1:9200" {
+			t.Errorf("unexpected url host for mode %q: %s", mode, req.URL.Host)
+		}
+	}
+}
+
+func TestUnixSocketBackend(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "app.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isWebsocket(r) {
+			websocketEchoHandler(t)(w, r)
+			return
+		}
+		fmt.Fprintf(w, "hello %s\n", r.URL.Path)
+	}))
+
+	for dest, expected := range map[string]string{
+		"unix://" + socket:           "hello /foo/bar\n",
+		"unix://" + socket + ":/api": "hello /api/foo/bar\n",
+	} {
+		u, sock, prefix, err := parseDest(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sock != socket {
+			t.Errorf("unexpected socket: %s", sock)
+		}
+		ws, _ := newWebsocketOptions(WebSocketConf{})
+		front := httptest.NewServer(newVirtualHostReverseProxy([]Backend{{URL: u, Socket: sock, PathPrefix: prefix, WebSocket: ws}}))
+
+		res, err := http.Get(front.URL + "/foo/bar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != expected {
+			t.Errorf("unexpected body for %s: %s", dest, body)
+		}
+
+		conn, br, res := dialWebsocketThrough(t, front.Listener.Addr().String(), "/ws")
+		if res.StatusCode != http.StatusSwitchingProtocols {
+			t.Errorf("unexpected websocket status: %s", res.Status)
+		} else {
+			writeFrame(conn, []byte("hello"), []byte{1, 2, 3, 4})
+			if payload, err := readFrame(br); err != nil || string(payload) != "hello" {
+				t.Errorf("unexpected websocket echo: %s %v", payload, err)
+			}
+		}
+		conn.Close()
+		front.Close()
+	}
+
+	if _, _, _, err := parseDest("unix://" + socket + ":api"); err == nil {
+		t.Errorf("path prefix without a slash should be an error")
+	}
+}
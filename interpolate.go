@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// envPattern matches ${VAR}, and $$ for a literal $.
+var envPattern = regexp.MustCompile(`\$\$|\$\{([^}]*)\}`)
+
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// expandEnv replaces ${VAR} in s by the value of the environment variable.
+// $$ is only unescaped in values with ${, others keep the value they had
+// before interpolation.
+func expandEnv(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var err error
+	expanded := envPattern.ReplaceAllStringFunc(s, func(m string) string {
+		if m == "$$" {
+			return "$"
+		}
+		name := m[2 : len(m)-1]
+		if !envName.MatchString(name) {
+			err = fmt.Errorf("invalid environment variable name: %s", m)
+			return m
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value
+	})
+	return expanded, err
+}
+
+// readSecretFile returns the content of a _file setting without the trailing
+// newline.
+func readSecretFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// yamlFields returns the fields of the struct type t by their yaml keys.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = t.Field(i).Type
+		}
+	}
+	return fields
+}
+
+// fileSetting returns the setting which key, e.g. "client_secret_file",
+// reads from a file, if there is one in fields.
+func fileSetting(fields map[string]reflect.Type, key string) (string, bool) {
+	name := strings.TrimSuffix(key, "_file")
+	if _, ok := fields[key]; ok || name == key || strings.HasSuffix(name, "_file") {
+		return "", false
+	}
+	ft, ok := fields[name]
+	return name, ok && ft.Kind() == reflect.String
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// resolveConf interpolates the yaml node n, which is going to be decoded
+// into t. For a string setting "key", "key_file" reads the value from a file.
+// The paths of settings from files or the environment are put into secrets.
+func resolveConf(n *yaml.Node, t reflect.Type, path string, secrets map[string]bool) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, c := range n.Content {
+			if err := resolveConf(c, t, path, secrets); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		switch t.Kind() {
+		case reflect.Struct:
+			return resolveStruct(n, t, path, secrets)
+		case reflect.Map:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				if err := resolveConf(n.Content[i+1], t.Elem(), joinPath(path, n.Content[i].Value), secrets); err != nil {
+					return err
+				}
+			}
+		}
+	case yaml.SequenceNode:
+		if t.Kind() == reflect.Slice {
+			for i, c := range n.Content {
+				if err := resolveConf(c, t.Elem(), fmt.Sprintf("%s[%d]", path, i), secrets); err != nil {
+					return err
+				}
+			}
+		}
+	case yaml.ScalarNode:
+		expanded, err := expandEnv(n.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: %s: %s", n.Line, path, err)
+		}
+		if expanded == n.Value {
+			return nil
+		}
+		n.Value = expanded
+		secrets[path] = true
+		if t.Kind() == reflect.String {
+			n.Tag = "!!str"
+		} else {
+			// e.g. a number or a bool from the environment
+			n.Tag, n.Style = "", 0
+		}
+	}
+	return nil
+}
+
+func resolveStruct(n *yaml.Node, t reflect.Type, path string, secrets map[string]bool) error {
+	fields := yamlFields(t)
+	keys := make(map[string]bool)
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		keys[n.Content[i].Value] = true
+	}
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		if ft, ok := fields[key.Value]; ok {
+			if err := resolveConf(value, ft, joinPath(path, key.Value), secrets); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name, ok := fileSetting(fields, key.Value)
+		if !ok {
+			continue // unknown keys are reported by checkNode
+		}
+		if keys[name] {
+			return fmt.Errorf("line %d: only one of %s and %s can be set", key.Line, joinPath(path, name), joinPath(path, key.Value))
+		}
+		if value.Kind != yaml.ScalarNode {
+			return fmt.Errorf("line %d: %s must be a file path", value.Line, joinPath(path, key.Value))
+		}
+		file, err := expandEnv(value.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: %s: %s", value.Line, joinPath(path, key.Value), err)
+		}
+		secret, err := readSecretFile(file)
+		if err != nil {
+			return fmt.Errorf("line %d: %s: %s", value.Line, joinPath(path, key.Value), err)
+		}
+		key.Value = name
+		value.Value, value.Tag, value.Style = secret, "!!str", 0
+		secrets[joinPath(path, name)] = true
+	}
+	return nil
+}
+
+// redactedDest hides the password of a dest URL, for logs and output.
+func redactedDest(dest string) string {
+	u, err := url.Parse(dest)
+	if err != nil || u.User == nil {
+		return dest
+	}
+	return u.Redacted()
+}
+
+// destError describes why the dest of the i-th proxy can't be parsed,
+// without the URL, which may hold a password. For a dest from the
+// environment or a file even the reason isn't shown, since url.Parse quotes
+// parts of the URL, e.g. of a password with a slash.
+func (c *Conf) destError(i int, err error) error {
+	if c.secrets[fmt.Sprintf("proxy[%d].dest", i)] {
+		return errors.New("invalid dest from the environment or a file")
+	}
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+	return fmt.Errorf("invalid dest: %s", err)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+)
+
+var sizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KB", 1 << 10},
+	{"MB", 1 << 20},
+	{"GB", 1 << 30},
+	{"K", 1 << 10},
+	{"M", 1 << 20},
+	{"G", 1 << 30},
+	{"B", 1},
+}
+
+// parseSize parses a size like "512KB", "10MB" or "1048576" (bytes). An
+// empty value is zero.
+func parseSize(name, value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	number, unit := value, int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(strings.ToUpper(value), u.suffix) {
+			number, unit = strings.TrimSpace(value[:len(value)-len(u.suffix)]), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s: %s (e.g. 512KB or 10MB)", name, value)
+	}
+	return n * unit, nil
+}
+
+// newServer returns the http.Server for handler with the timeouts and limits
+// of the server config.
+func newServer(c *Conf, handler http.Handler) (*http.Server, error) {
+	server := &http.Server{
+		Addr:           c.Addr,
+		Handler:        handler,
+		MaxHeaderBytes: c.Server.MaxHeaderBytes,
+	}
+	if server.MaxHeaderBytes < 0 {
+		return nil, errors.New("max_header_bytes must not be negative")
+	}
+
+	var err error
+	if server.ReadHeaderTimeout, err = parseDuration("read_header_timeout", c.Server.ReadHeaderTimeout); err != nil {
+		return nil, err
+	}
+	if server.ReadTimeout, err = parseDuration("read_timeout", c.Server.ReadTimeout); err != nil {
+		return nil, err
+	}
+	if server.WriteTimeout, err = parseDuration("write_timeout", c.Server.WriteTimeout); err != nil {
+		return nil, err
+	}
+	if server.IdleTimeout, err = parseDuration("idle_timeout", c.Server.IdleTimeout); err != nil {
+		return nil, err
+	}
+
+	if server.ReadHeaderTimeout == 0 {
+		server.ReadHeaderTimeout = defaultReadHeaderTimeout
+	}
+	if server.IdleTimeout == 0 {
+		server.IdleTimeout = defaultIdleTimeout
+	}
+	return server, nil
+}
+
+// limitBody answers 413 if the request body is known to be larger than
+// allowed, and otherwise makes reading beyond the limit fail; errorHandler
+// then answers 413.
+func (b *Backend) limitBody(w http.ResponseWriter, r *http.Request) bool {
+	if b.MaxBodySize <= 0 {
+		return true
+	}
+	if r.ContentLength > b.MaxBodySize {
+		serveBodyTooLarge(w)
+		return false
+	}
+	if r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, b.MaxBodySize)
+	}
+	return true
+}
+
+func isBodyTooLarge(err error) bool {
+	var maxBytesError *http.MaxBytesError
+	return errors.As(err, &maxBytesError)
+}
+
+func serveBodyTooLarge(w http.ResponseWriter) {
+	http.Error(w, "413 Request Entity Too Large", http.StatusRequestEntityTooLarge)
+}
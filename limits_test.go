@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value string
+		size  int64
+		ok    bool
+	}{
+		{"", 0, true},
+		{"1048576", 1 << 20, true},
+		{"512KB", 512 << 10, true},
+		{"10MB", 10 << 20, true},
+		{"10mb", 10 << 20, true},
+		{"1G", 1 << 30, true},
+		{"100 B", 100, true},
+		{"-1MB", 0, false},
+		{"lots", 0, false},
+	}
+	for _, test := range tests {
+		size, err := parseSize("max_body_size", test.value)
+		if (err == nil) != test.ok || size != test.size {
+			t.Errorf("%q: unexpected result %d, %v", test.value, size, err)
+		}
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	server, err := newServer(&Conf{Addr: ":9999"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.ReadHeaderTimeout != defaultReadHeaderTimeout || server.IdleTimeout != defaultIdleTimeout {
+		t.Errorf("unexpected defaults: %+v", server)
+	}
+	if server.ReadTimeout != 0 || server.WriteTimeout != 0 {
+		t.Errorf("streams are limited by default: %+v", server)
+	}
+
+	server, err = newServer(&Conf{Server: ServerConf{
+		ReadHeaderTimeout: "2s",
+		ReadTimeout:       "30s",
+		WriteTimeout:      "1m",
+		IdleTimeout:       "90s",
+		MaxHeaderBytes:    16384,
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.ReadHeaderTimeout != 2*time.Second || server.ReadTimeout != 30*time.Second ||
+		server.WriteTimeout != time.Minute || server.IdleTimeout != 90*time.Second ||
+		server.MaxHeaderBytes != 16384 {
+		t.Errorf("unexpected settings: %+v", server)
+	}
+
+	if _, err := newServer(&Conf{Server: ServerConf{WriteTimeout: "soon"}}, nil); err == nil {
+		t.Error("invalid timeout accepted")
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	front := httptest.NewServer(newVirtualHostReverseProxy([]Backend{{URL: u, MaxBodySize: 10}}))
+	defer front.Close()
+
+	post := func(body io.Reader) *http.Response {
+		res, err := http.Post(front.URL+"/upload", "text/plain", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := post(strings.NewReader("small"))
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "small" {
+		t.Errorf("unexpected response: %s %q", res.Status, body)
+	}
+
+	res = post(strings.NewReader(strings.Repeat("x", 100)))
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("unexpected status with Content-Length: %s", res.Status)
+	}
+
+	// chunked, so the size is unknown until the body has been read
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < 10; i++ {
+			pw.Write([]byte("0123456789"))
+		}
+		pw.Close()
+	}()
+	res = post(pr)
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("unexpected status for chunked body: %s", res.Status)
+	}
+}
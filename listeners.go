@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// listener address prefixes, anything else is a TCP address
+const (
+	unixListenerPrefix    = "unix://"
+	systemdListenerPrefix = "systemd:"
+)
+
+// sdListenFDsStart is the first file descriptor passed by systemd.
+const sdListenFDsStart = 3
+
+// systemd keeps the sockets passed by systemd, by index and by name.
+var systemd struct {
+	once      sync.Once
+	listeners map[string]net.Listener
+	err       error
+}
+
+// hasCertificates tells whether gate has certificates to serve TLS with.
+func hasCertificates(c SSLConf) bool {
+	return c.Cert != "" || c.Key != "" || len(c.Certificates) > 0 || c.CertDir != "" || c.ACME != nil
+}
+
+// listenerConfs returns the listeners to serve. Without a listeners list,
+// gate serves address, over TLS if there are certificates.
+func listenerConfs(c *Conf) ([]ListenerConf, error) {
+	if len(c.Listeners) == 0 {
+		if c.Addr == "" {
+			return nil, errors.New("address config is required")
+		}
+		return []ListenerConf{{Address: c.Addr, TLS: hasCertificates(c.SSL)}}, nil
+	}
+	if c.Addr != "" {
+		return nil, errors.New("address and listeners can't be used together")
+	}
+
+	hasTLS := false
+	for i, l := range c.Listeners {
+		if err := checkListenerAddress(l.Address); err != nil {
+			return nil, fmt.Errorf("listeners[%d].address: %s", i, err)
+		}
+		if l.TLS && l.RedirectToHTTPS {
+			return nil, fmt.Errorf("listeners[%d]: tls and redirect_to_https can't be used together", i)
+		}
+		if l.TLS && !hasCertificates(c.SSL) {
+			return nil, fmt.Errorf("listeners[%d]: tls needs ssl certificates", i)
+		}
+		hasTLS = hasTLS || l.TLS
+	}
+	if hasCertificates(c.SSL) && !hasTLS {
+		return nil, errors.New("ssl certificates are configured, but no listener has tls enabled")
+	}
+	return c.Listeners, nil
+}
+
+func checkListenerAddress(address string) error {
+	switch {
+	case address == "":
+		return errors.New("required")
+	case strings.HasPrefix(address, unixListenerPrefix):
+		if !strings.HasPrefix(address, unixListenerPrefix+"/") {
+			return fmt.Errorf("the socket path must be absolute: %s", address)
+		}
+	case strings.HasPrefix(address, systemdListenerPrefix):
+		if address == systemdListenerPrefix {
+			return fmt.Errorf("a socket name or index is required: %s", address)
+		}
+	default:
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listen opens a TCP address, a Unix domain socket ("unix:///run/gate.sock")
+// or takes a socket passed by systemd ("systemd:https", by FileDescriptorName
+// or index). Sockets handed over by a previous gate process come first.
+func listen(address string) (net.Listener, error) {
+	if l := inheritedListener(address); l != nil {
+		return l, nil
+	}
+	switch {
+	case strings.HasPrefix(address, unixListenerPrefix):
+		return listenUnix(strings.TrimPrefix(address, unixListenerPrefix))
+	case strings.HasPrefix(address, systemdListenerPrefix):
+		return systemdListener(strings.TrimPrefix(address, systemdListenerPrefix))
+	}
+	return net.Listen("tcp", address)
+}
+
+// listenUnix listens on a unix socket. A socket left over by a crashed
+// process is removed, one which is still served on isn't taken over.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		conn, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, err
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+func systemdListener(name string) (net.Listener, error) {
+	systemd.once.Do(func() {
+		systemd.listeners, systemd.err = listenFDs(os.Getenv, sdListenFDsStart)
+		// not for child processes
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	})
+	if systemd.err != nil {
+		return nil, systemd.err
+	}
+	l, ok := systemd.listeners[name]
+	if !ok {
+		return nil, fmt.Errorf("no socket %q passed by systemd", name)
+	}
+	return l, nil
+}
+
+// listenFDs implements the systemd socket activation protocol (see
+// sd_listen_fds(3)): LISTEN_FDS sockets start at the first file descriptor,
+// LISTEN_FDNAMES names them.
+func listenFDs(getenv func(string) string, first int) (map[string]net.Listener, error) {
+	if getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, errors.New("no sockets passed by systemd (LISTEN_PID is not set to this process)")
+	}
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, errors.New("no sockets passed by systemd (invalid LISTEN_FDS)")
+	}
+	var names []string
+	if v := getenv("LISTEN_FDNAMES"); v != "" {
+		names = strings.Split(v, ":")
+	}
+
+	files, err := fileListeners(first, n)
+	if err != nil {
+		return nil, fmt.Errorf("sockets passed by systemd: %s", err)
+	}
+	listeners := make(map[string]net.Listener)
+	for i, l := range files {
+		listeners[strconv.Itoa(i)] = l
+		if i < len(names) && names[i] != "" {
+			listeners[names[i]] = l
+		}
+	}
+	return listeners, nil
+}
+
+// fileListeners returns the listeners for n sockets starting at the file
+// descriptor first.
+func fileListeners(first, n int) ([]net.Listener, error) {
+	listeners := make([]net.Listener, n)
+	for i := range listeners {
+		f := os.NewFile(uintptr(first+i), "listener")
+		l, err := net.FileListener(f)
+		// FileListener works on a copy of the descriptor
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d: %s", i, err)
+		}
+		listeners[i] = l
+	}
+	return listeners, nil
+}
+
+// httpsPort returns the port to redirect to: the one of the first TLS
+// listener, or "" for the default port.
+func httpsPort(confs []ListenerConf) string {
+	for _, l := range confs {
+		if !l.TLS {
+			continue
+		}
+		if strings.HasPrefix(l.Address, unixListenerPrefix) || strings.HasPrefix(l.Address, systemdListenerPrefix) {
+			// behind something else or bound by systemd, likely to :443
+			return ""
+		}
+		if _, port, err := net.SplitHostPort(l.Address); err == nil && port != "443" {
+			return port
+		}
+		return ""
+	}
+	return ""
+}
+
+// redirectToHTTPS redirects every request to the same URL over HTTPS.
+func redirectToHTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "" {
+			http.Error(w, "Host header required", http.StatusBadRequest)
+			return
+		}
+		host := stripPort(r.Host)
+		if port != "" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		// keep the method and body of non-GET requests
+		code := http.StatusMovedPermanently
+		if r.Method != "GET" && r.Method != "HEAD" {
+			code = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+	})
+}
+
+// serve opens all listeners and serves handler on them, or the redirect to
+// HTTPS on those with redirect_to_https. It returns when one of them fails
+// or gate has been shut down.
+func (s *Server) serve(handler http.Handler) error {
+	confs, err := listenerConfs(s.Conf)
+	if err != nil {
+		return err
+	}
+
+	acmeManager, err := newACMEManager(s.Conf)
+	if err != nil {
+		return err
+	}
+	certificates, err := newCertificateStore(s.Conf.SSL)
+	if err != nil {
+		return err
+	}
+
+	redirect := redirectToHTTPS(httpsPort(confs))
+	var tlsConfig *tls.Config
+	if acmeManager != nil {
+		log.Printf("getting certificates via ACME for %s", strings.Join(acmeHosts(s.Conf), ", "))
+		if addr := acmeHTTPAddr(s.Conf, confs); addr != "" {
+			go serveACMEChallenges(s.Conf, addr, acmeManager)
+		}
+		// the redirect listeners answer HTTP-01 challenges too
+		redirect = acmeManager.HTTPHandler(redirect)
+		// answers TLS-ALPN-01 challenges
+		tlsConfig = acmeManager.TLSConfig()
+	} else if certificates != nil {
+		tlsConfig = &tls.Config{GetCertificate: certificates.getCertificate}
+	}
+
+	if tlsConfig != nil {
+		if err := configureServerTLS(tlsConfig, s.Conf.SSL); err != nil {
+			return err
+		}
+		hsts, err := newHSTSHeader(s.Conf.SSL.HSTS)
+		if err != nil {
+			return err
+		}
+		if hsts != "" {
+			handler = hstsHandler(hsts, handler)
+		}
+	}
+
+	servers := make([]*http.Server, len(confs))
+	for i, l := range confs {
+		h := handler
+		if l.RedirectToHTTPS {
+			h = redirect
+		}
+		if servers[i], err = newServer(s.Conf, h); err != nil {
+			return err
+		}
+		servers[i].Addr = l.Address
+		if l.TLS {
+			servers[i].TLSConfig = tlsConfig.Clone()
+			// HTTP/2, needed by gRPC clients
+			if err := http2.ConfigureServer(servers[i], nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	listeners := make([]net.Listener, 0, len(confs))
+	for _, l := range confs {
+		listener, err := listen(l.Address)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+
+	errs := make(chan error, len(servers))
+	for i, l := range confs {
+		switch {
+		case l.TLS:
+			log.Printf("starting server at %s (TLS)", l.Address)
+		case l.RedirectToHTTPS:
+			log.Printf("redirecting to HTTPS at %s", l.Address)
+		default:
+			log.Printf("starting server at %s", l.Address)
+		}
+		go func(server *http.Server, listener net.Listener, useTLS bool) {
+			if useTLS {
+				errs <- server.ServeTLS(listener, "", "")
+			} else {
+				errs <- server.Serve(listener)
+			}
+		}(servers[i], listeners[i], l.TLS)
+	}
+	notifyReady()
+
+	return s.wait(servers, confs, listeners, errs)
+}
+
+func hasRedirectListener(confs []ListenerConf) bool {
+	for _, l := range confs {
+		if l.RedirectToHTTPS {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestListenerConfs(t *testing.T) {
+	confs, err := listenerConfs(&Conf{Addr: ":9999", SSL: SSLConf{Cert: "gate.crt", Key: "gate.key"}})
+	if err != nil || len(confs) != 1 || confs[0].Address != ":9999" || !confs[0].TLS {
+		t.Errorf("unexpected listeners for address: %+v, %v", confs, err)
+	}
+
+	tests := []struct {
+		conf Conf
+		ok   bool
+	}{
+		{Conf{}, false},
+		{Conf{Listeners: []ListenerConf{{Address: ":80"}}}, true},
+		{Conf{Listeners: []ListenerConf{{Address: ":443", TLS: true}, {Address: ":80", RedirectToHTTPS: true}}, SSL: SSLConf{CertDir: "/etc/gate/certs"}}, true},
+		{Conf{Listeners: []ListenerConf{{Address: "unix:///run/gate.sock"}, {Address: "systemd:https"}}}, true},
+		{Conf{Addr: ":9999", Listeners: []ListenerConf{{Address: ":80"}}}, false},
+		{Conf{Listeners: []ListenerConf{{Address: ""}}}, false},
+		{Conf{Listeners: []ListenerConf{{Address: "80"}}}, false},
+		{Conf{Listeners: []ListenerConf{{Address: "unix://gate.sock"}}}, false},
+		{Conf{Listeners: []ListenerConf{{Address: "systemd:"}}}, false},
+		{Conf{Listeners: []ListenerConf{{Address: ":443", TLS: true}}}, false},
+		{Conf{Listeners: []ListenerConf{{Address: ":80", TLS: true, RedirectToHTTPS: true}}, SSL: SSLConf{CertDir: "/etc/gate/certs"}}, false},
+		{Conf{Listeners: []ListenerConf{{Address: ":80"}}, SSL: SSLConf{CertDir: "/etc/gate/certs"}}, false},
+	}
+	for i, test := range tests {
+		if _, err := listenerConfs(&test.conf); (err == nil) != test.ok {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		port     string
+		method   string
+		url      string
+		code     int
+		location string
+	}{
+		{"", "GET", "http://gate.example.com/foo?bar=1", http.StatusMovedPermanently, "https://gate.example.com/foo?bar=1"},
+		{"", "GET", "http://gate.example.com:80/a%2Fb", http.StatusMovedPermanently, "https://gate.example.com/a%2Fb"},
+		{"8443", "HEAD", "http://gate.example.com:8080/", http.StatusMovedPermanently, "https://gate.example.com:8443/"},
+		{"", "POST", "http://[::1]/api", http.StatusPermanentRedirect, "https://[::1]/api"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		redirectToHTTPS(test.port).ServeHTTP(w, httptest.NewRequest(test.method, test.url, nil))
+		if w.Code != test.code || w.Header().Get("Location") != test.location {
+			t.Errorf("%s %s: unexpected redirect %d to %s", test.method, test.url, w.Code, w.Header().Get("Location"))
+		}
+	}
+
+	ports := map[string][]ListenerConf{
+		"":     {{Address: ":80", RedirectToHTTPS: true}, {Address: ":443", TLS: true}},
+		"8443": {{Address: "127.0.0.1:8443", TLS: true}},
+	}
+	for port, confs := range ports {
+		if p := httpsPort(confs); p != port {
+			t.Errorf("unexpected port %q instead of %q", p, port)
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gate-listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "gate.sock")
+
+	// a socket left over by a crashed run
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listen(unixListenerPrefix + socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+
+	if body := getUnix(t, socket); body != "hello" {
+		t.Errorf("unexpected body: %q", body)
+	}
+
+	// a second instance doesn't take over the socket
+	if _, err := listen(unixListenerPrefix + socket); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("socket in use taken over: %v", err)
+	}
+	if body := getUnix(t, socket); body != "hello" {
+		t.Errorf("unexpected body after a second listen: %q", body)
+	}
+}
+
+func getUnix(t *testing.T, socket string) string {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.0\r\nHost: gate\r\n\r\n"))
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return string(body)
+}
+
+func TestListenFDs(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// listenFDs takes over the descriptor
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		"LISTEN_PID":     strconv.Itoa(os.Getpid()),
+		"LISTEN_FDS":     "1",
+		"LISTEN_FDNAMES": "https",
+	}
+	listeners, err := listenFDs(func(key string) string { return env[key] }, fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listeners["0"] == nil || listeners["https"] != listeners["0"] {
+		t.Fatalf("unexpected listeners: %v", listeners)
+	}
+	if listeners["0"].Addr().String() != l.Addr().String() {
+		t.Errorf("unexpected address: %s", listeners["0"].Addr())
+	}
+	listeners["0"].Close()
+
+	env["LISTEN_PID"] = "1"
+	if _, err := listenFDs(func(key string) string { return env[key] }, fd); err == nil {
+		t.Error("sockets for another process accepted")
+	}
+}
@@ -1,15 +1,36 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"os"
 )
 
 var (
 	confFile = flag.String("conf", "config.yml", "config file path")
 )
 
+// commands are run as "gate <command> [-conf config.yml] [args]".
+var commands = map[string]func(conf string, args []string, w io.Writer) int{
+	"check":  checkCommand,
+	"routes": routesCommand,
+	"match":  matchCommand,
+	"schema": schemaCommand,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+			conf := flags.String("conf", "config.yml", "config file path")
+			flags.Parse(os.Args[2:])
+			os.Exit(command(*conf, flags.Args(), os.Stdout))
+		}
+	}
+
 	flag.Parse()
 
 	conf, err := ParseConf(*confFile)
@@ -20,5 +41,70 @@ func main() {
 	conf.SetOAuth2Paths()
 
 	server := NewServer(conf)
-	log.Fatal(server.Run())
+	server.ConfFile = *confFile
+	if err := server.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// checkCommand validates the config and prints every problem found.
+func checkCommand(conf string, args []string, w io.Writer) int {
+	problems := checkConf(conf)
+	for _, p := range problems {
+		fmt.Fprintf(w, "%s: %s\n", conf, p)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	fmt.Fprintf(w, "%s: OK\n", conf)
+	return 0
+}
+
+// routesCommand prints the routing table.
+func routesCommand(conf string, args []string, w io.Writer) int {
+	c, err := ParseConf(conf)
+	if err != nil {
+		fmt.Fprintf(w, "%s: %s\n", conf, err)
+		return 1
+	}
+	c.SetOAuth2Paths()
+	printRoutes(w, c)
+	return 0
+}
+
+// matchCommand shows the route and policy for the URLs given.
+func matchCommand(conf string, args []string, w io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintln(w, "usage: gate match [-conf config.yml] URL...")
+		return 2
+	}
+	c, err := ParseConf(conf)
+	if err != nil {
+		fmt.Fprintf(w, "%s: %s\n", conf, err)
+		return 1
+	}
+	c.SetOAuth2Paths()
+	status := 0
+	for i, u := range args {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintln(w, u)
+		if err := printMatch(w, c, u); err != nil {
+			fmt.Fprintln(w, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// schemaCommand prints a JSON Schema of the config file.
+func schemaCommand(conf string, args []string, w io.Writer) int {
+	data, err := json.MarshalIndent(confSchema(), "", "  ")
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 1
+	}
+	fmt.Fprintf(w, "%s\n", data)
+	return 0
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sync"
+)
+
+// metrics are published with expvar under "gate" and served, together with
+// the runtime metrics of expvar, at <admin.path>/vars.
+var metrics = expvar.NewMap("gate")
+
+var currentBackends struct {
+	sync.Mutex
+	list []*Backend
+}
+
+func init() {
+	metrics.Set("backends", expvar.Func(func() interface{} {
+		return backendStatuses()
+	}))
+}
+
+type backendStatus struct {
+	Name           string         `json:"name"`
+	Dest           string         `json:"dest"`
+	CircuitBreaker *breakerStatus `json:"circuit_breaker,omitempty"`
+}
+
+// registerBackends sets the backends reported by metrics and the admin
+// endpoint.
+func registerBackends(list []*Backend) {
+	currentBackends.Lock()
+	defer currentBackends.Unlock()
+
+	currentBackends.list = list
+}
+
+func backendStatuses() []backendStatus {
+	currentBackends.Lock()
+	defer currentBackends.Unlock()
+
+	statuses := make([]backendStatus, 0, len(currentBackends.list))
+	for _, b := range currentBackends.list {
+		s := backendStatus{Name: b.name(), Dest: b.Dest}
+		if b.Breaker != nil {
+			status := b.Breaker.status()
+			s.CircuitBreaker = &status
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+func adminBackendsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(backendStatuses())
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	ocspRetryInterval   = 5 * time.Minute
+	ocspDefaultValidity = time.Hour
+	ocspMaxResponseSize = 1 << 20
+)
+
+var ocspClient = &http.Client{Timeout: 10 * time.Second}
+
+// fetchOCSPStaple asks the OCSP responder of leaf for the status of the
+// certificate and returns the raw and the parsed response if it's good.
+func fetchOCSPStaple(chain [][]byte, leaf *x509.Certificate) ([]byte, *ocsp.Response, error) {
+	if len(leaf.OCSPServer) == 0 {
+		return nil, nil, errors.New("the certificate names no OCSP responder")
+	}
+	if len(chain) < 2 {
+		return nil, nil, errors.New("the issuer certificate is missing from the chain")
+	}
+	issuer, err := x509.ParseCertificate(chain[1])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	res, err := ocspClient.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("OCSP responder answered %s", res.Status)
+	}
+	staple, err := ioutil.ReadAll(io.LimitReader(res.Body, ocspMaxResponseSize))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	status, err := ocsp.ParseResponseForCert(staple, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if status.Status != ocsp.Good {
+		return nil, nil, fmt.Errorf("OCSP status is not good: %d", status.Status)
+	}
+	return staple, status, nil
+}
+
+// refreshOCSP starts fetching new OCSP staples for the certificates which
+// need one. It has to be called with s.mu held.
+func (s *certificateStore) refreshOCSP(now time.Time) {
+	for _, lc := range s.certs {
+		if lc.ocspFetching || now.Before(lc.ocspRefresh) {
+			continue
+		}
+		lc.ocspFetching = true
+		go s.staple(lc)
+	}
+}
+
+// staple replaces the OCSP staple of lc. If that fails, an expired staple is
+// dropped.
+func (s *certificateStore) staple(lc *loadedCertificate) {
+	staple, status, err := fetchOCSPStaple(lc.cert.Certificate, lc.leaf)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	lc.ocspFetching = false
+	if err != nil {
+		log.Printf("failed to get OCSP staple for %s: %s", lc.Cert, err)
+		lc.ocspRefresh = now.Add(ocspRetryInterval)
+		if lc.cert.OCSPStaple == nil || now.Before(lc.ocspExpires) {
+			return
+		}
+		// staple is nil, dropping the expired one
+	} else {
+		// refresh halfway through the validity of the response
+		lc.ocspRefresh = now.Add(ocspDefaultValidity)
+		lc.ocspExpires = lc.ocspRefresh
+		if !status.NextUpdate.IsZero() {
+			lc.ocspRefresh = status.ThisUpdate.Add(status.NextUpdate.Sub(status.ThisUpdate) / 2)
+			lc.ocspExpires = status.NextUpdate
+		}
+	}
+
+	cert := *lc.cert
+	cert.OCSPStaple = staple
+	lc.cert = &cert
+}
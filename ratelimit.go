@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rate_limit.key values
+const (
+	RateLimitByUser  = "user"
+	RateLimitByIP    = "ip"
+	RateLimitByRoute = "route"
+)
+
+const rateLimitPruneInterval = time.Minute
+
+// rateLimited counts the requests rejected by each limiter.
+var rateLimited = new(expvar.Map).Init()
+
+func init() {
+	metrics.Set("rate_limited", rateLimited)
+}
+
+// rateLimiter is a token bucket per key: a bucket holds up to burst tokens,
+// is refilled at rate tokens per second and every request takes one token.
+type rateLimiter struct {
+	name  string
+	key   string
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// parseRate parses a rate like "10/s", "600/m" or "100/10s" into requests
+// per second.
+func parseRate(value string) (float64, error) {
+	i := strings.Index(value, "/")
+	if i < 0 {
+		return 0, fmt.Errorf("invalid rate_limit.rate: %s (e.g. 10/s or 600/m)", value)
+	}
+	n, err := strconv.ParseFloat(value[:i], 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid rate_limit.rate: %s (e.g. 10/s or 600/m)", value)
+	}
+
+	var per time.Duration
+	switch unit := value[i+1:]; unit {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		if per, err = time.ParseDuration(unit); err != nil || per <= 0 {
+			return 0, fmt.Errorf("invalid rate_limit.rate: %s (e.g. 10/s or 600/m)", value)
+		}
+	}
+	return n / per.Seconds(), nil
+}
+
+// newRateLimiter returns nil if no rate is configured.
+func newRateLimiter(name string, c RateLimitConf) (*rateLimiter, error) {
+	if c.Rate == "" {
+		if c != (RateLimitConf{}) {
+			return nil, errors.New("rate_limit.rate is required")
+		}
+		return nil, nil
+	}
+	rate, err := parseRate(c.Rate)
+	if err != nil {
+		return nil, err
+	}
+	if c.Burst < 0 {
+		return nil, errors.New("rate_limit.burst must not be negative")
+	}
+
+	l := &rateLimiter{
+		name:    name,
+		key:     c.Key,
+		rate:    rate,
+		burst:   float64(c.Burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+	switch l.key {
+	case "":
+		l.key = RateLimitByIP
+	case RateLimitByUser, RateLimitByIP, RateLimitByRoute:
+	default:
+		return nil, fmt.Errorf("invalid rate_limit.key: %s (must be %s, %s or %s)", c.Key, RateLimitByUser, RateLimitByIP, RateLimitByRoute)
+	}
+	if l.burst == 0 {
+		// a second worth of requests
+		l.burst = math.Max(1, math.Ceil(rate))
+	}
+	return l, nil
+}
+
+// bucketKey returns the key of the bucket for a request to b. Requests
+// without a logged in user are limited by their IP.
+func (l *rateLimiter) bucketKey(b *Backend, info *requestInfo) string {
+	switch l.key {
+	case RateLimitByRoute:
+		return "route:" + b.name()
+	case RateLimitByUser:
+		if info.User.Email != "" {
+			return "user:" + info.User.Email
+		}
+		if info.User.Login != "" {
+			return "user:" + info.User.Login
+		}
+		if info.User.SPIFFEID != "" {
+			return "user:" + info.User.SPIFFEID
+		}
+		if info.User.CommonName != "" {
+			return "user:" + info.User.CommonName
+		}
+	}
+	return "ip:" + info.ClientIP
+}
+
+// take takes a token from the bucket of key. If it's empty, it returns how
+// long it takes until the next token is available.
+func (l *rateLimiter) take(key string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastPrune) >= rateLimitPruneInterval {
+		l.prune(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// prune drops the buckets which have been refilled completely, they are
+// recreated as needed.
+func (l *rateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPrune = now
+}
+
+func nonNilRateLimiters(limiters ...*rateLimiter) []*rateLimiter {
+	var list []*rateLimiter
+	for _, l := range limiters {
+		if l != nil {
+			list = append(list, l)
+		}
+	}
+	return list
+}
+
+// allowRequest applies the rate limits of b, answering 429 if one of them is
+// exceeded.
+func (b *Backend) allowRequest(w http.ResponseWriter, r *http.Request) bool {
+	if len(b.RateLimiters) == 0 {
+		return true
+	}
+
+	info := requestInfoFrom(r)
+	now := time.Now()
+	for _, l := range b.RateLimiters {
+		wait := l.take(l.bucketKey(b, info), now)
+		if wait == 0 {
+			continue
+		}
+		rateLimited.Add(l.name, 1)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "429 Too Many Requests", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
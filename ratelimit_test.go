@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		value string
+		rate  float64
+		ok    bool
+	}{
+		{"10/s", 10, true},
+		{"600/m", 10, true},
+		{"36/h", 0.01, true},
+		{"5/500ms", 10, true},
+		{"10", 0, false},
+		{"0/s", 0, false},
+		{"ten/s", 0, false},
+		{"10/fortnight", 0, false},
+	}
+	for _, test := range tests {
+		rate, err := parseRate(test.value)
+		if (err == nil) != test.ok || rate != test.rate {
+			t.Errorf("%s: unexpected result %v, %v", test.value, rate, err)
+		}
+	}
+}
+
+func TestRateLimiterTake(t *testing.T) {
+	l, err := newRateLimiter("test", RateLimitConf{Rate: "2/s", Burst: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if wait := l.take("a", now); wait != 0 {
+			t.Fatalf("request %d within burst rejected", i)
+		}
+	}
+	if wait := l.take("a", now); wait != 500*time.Millisecond {
+		t.Errorf("unexpected wait: %s", wait)
+	}
+	if wait := l.take("b", now); wait != 0 {
+		t.Error("buckets are not separated by key")
+	}
+	if wait := l.take("a", now.Add(500*time.Millisecond)); wait != 0 {
+		t.Error("bucket not refilled")
+	}
+
+	l.take("b", now.Add(2*rateLimitPruneInterval))
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("full bucket not pruned")
+	}
+}
+
+func TestRateLimiterConf(t *testing.T) {
+	tests := []struct {
+		conf RateLimitConf
+		ok   bool
+	}{
+		{RateLimitConf{}, true},
+		{RateLimitConf{Rate: "10/s"}, true},
+		{RateLimitConf{Rate: "10/s", Key: RateLimitByUser}, true},
+		{RateLimitConf{Rate: "10/s", Key: RateLimitByRoute, Burst: 50}, true},
+		{RateLimitConf{Key: RateLimitByUser}, false},
+		{RateLimitConf{Rate: "10/s", Key: "cookie"}, false},
+		{RateLimitConf{Rate: "10/s", Burst: -1}, false},
+	}
+	for i, test := range tests {
+		_, err := newRateLimiter("test", test.conf)
+		if (err == nil) != test.ok {
+			t.Errorf("test %d: unexpected result: %v", i, err)
+		}
+	}
+}
+
+func TestRateLimitedProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok\n")
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	global, _ := newRateLimiter("global", RateLimitConf{Rate: "100/s"})
+	route, _ := newRateLimiter("/es/", RateLimitConf{Rate: "1/m", Burst: 2, Key: RateLimitByUser})
+	proxy := newVirtualHostReverseProxy([]Backend{{URL: u, StripPath: "/es/", RateLimiters: []*rateLimiter{global, route}}})
+
+	serve := func(email string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://gate.example.com/es/_search", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, withRequestInfo(r, &User{Email: email}))
+		return w
+	}
+
+	before := rateLimited.Get("/es/")
+	for i := 0; i < 2; i++ {
+		if w := serve("alice@example.com"); w.Code != http.StatusOK {
+			t.Fatalf("request %d: unexpected status %d", i, w.Code)
+		}
+	}
+	w := serve("alice@example.com")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "60" {
+		t.Errorf("unexpected Retry-After: %s", w.Header().Get("Retry-After"))
+	}
+	if w := serve("bob@example.com"); w.Code != http.StatusOK {
+		t.Errorf("other user limited: %d", w.Code)
+	}
+	if after := rateLimited.Get("/es/"); after == nil || (before != nil && after.String() == before.String()) {
+		t.Errorf("rejection not counted: %v", after)
+	}
+}
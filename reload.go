@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const defaultReloadInterval = 2 * time.Second
+
+// restartSettings can't be changed by a reload, the listeners and their TLS
+// settings stay as they are. The OAuth paths are globals of the oauth2
+// package, which requests being served read.
+var restartSettings = []string{"address", "listeners", "ssl", "server", "reload", "paths"}
+
+// secretSettings are masked in the logged diff.
+var secretSettings = []string{"auth.session.key", "client_secret", "password", "bearer"}
+
+// reloadableHandler serves with the handler of the current config, so it can
+// be swapped while requests are running.
+type reloadableHandler struct {
+	v atomic.Value
+}
+
+type handlerBox struct {
+	http.Handler
+}
+
+func (h *reloadableHandler) set(handler http.Handler) {
+	h.v.Store(handlerBox{handler})
+}
+
+func (h *reloadableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.v.Load().(handlerBox).ServeHTTP(w, r)
+}
+
+// proxyState holds the circuit breakers and rate limiters of a handler, so a
+// reload keeps their state for proxies whose settings didn't change.
+type proxyState struct {
+	breakers     map[string]*circuitBreaker
+	rateLimiters map[string]*rateLimiter
+}
+
+func newProxyState() *proxyState {
+	return &proxyState{
+		breakers:     make(map[string]*circuitBreaker),
+		rateLimiters: make(map[string]*rateLimiter),
+	}
+}
+
+func stateKey(name string, c interface{}) string {
+	return fmt.Sprintf("%s %#v", name, c)
+}
+
+// breaker returns the breaker of prev for the same name and settings, or a
+// new one.
+func (st *proxyState) breaker(prev *proxyState, name string, c CircuitBreakerConf) (*circuitBreaker, error) {
+	key := stateKey(name, c)
+	cb, ok := prev.breakers[key]
+	if !ok {
+		var err error
+		if cb, err = newCircuitBreaker(name, c); err != nil {
+			return nil, err
+		}
+	}
+	st.breakers[key] = cb
+	return cb, nil
+}
+
+// rateLimiter returns the limiter of prev for the same name and settings,
+// with its buckets, or a new one.
+func (st *proxyState) rateLimiter(prev *proxyState, name string, c RateLimitConf) (*rateLimiter, error) {
+	key := stateKey(name, c)
+	l, ok := prev.rateLimiters[key]
+	if !ok {
+		var err error
+		if l, err = newRateLimiter(name, c); err != nil {
+			return nil, err
+		}
+	}
+	st.rateLimiters[key] = l
+	return l, nil
+}
+
+// sessionKeyPairs returns the keys for the cookie store: the current key
+// signs new sessions, the key from before the last rotation still verifies
+// the existing ones.
+func (s *Server) sessionKeyPairs() [][]byte {
+	var pairs [][]byte
+	for _, key := range s.sessionKeys {
+		// no encryption, like a single key
+		pairs = append(pairs, []byte(key), nil)
+	}
+	return pairs
+}
+
+// rotateSessionKeys makes key the current session key. Only the previous key
+// stays valid, so a second rotation revokes the sessions signed before the
+// first one.
+func rotateSessionKeys(keys []string, key string) []string {
+	if key == keys[0] {
+		return keys
+	}
+	return []string{key, keys[0]}
+}
+
+// reload reads the config file again and, if it's valid, swaps the routing
+// table, restrictions and authenticator. Sessions and listeners are kept.
+func (s *Server) reload() error {
+	if s.ConfFile == "" {
+		return errors.New("no config file to reload")
+	}
+	c, err := ParseConf(s.ConfFile)
+	if err != nil {
+		return err
+	}
+
+	changes := confDiff(s.Conf, c)
+	if len(changes) == 0 {
+		log.Printf("config unchanged")
+		return nil
+	}
+	var restart []string
+	for _, change := range changes {
+		if change.needsRestart() {
+			restart = append(restart, change.path)
+		}
+	}
+	if len(restart) > 0 {
+		return fmt.Errorf("changes of %s need a restart (SIGUSR2)", strings.Join(restart, ", "))
+	}
+
+	old, oldKeys := s.Conf, s.sessionKeys
+	s.Conf = c
+	s.sessionKeys = rotateSessionKeys(oldKeys, c.Auth.Session.Key)
+	handler, err := s.newHandler()
+	if err != nil {
+		s.Conf, s.sessionKeys = old, oldKeys
+		return err
+	}
+	s.handler.set(handler)
+
+	log.Printf("config reloaded:")
+	for _, change := range changes {
+		log.Printf("  %s", change)
+	}
+	return nil
+}
+
+func (s *Server) logReload() {
+	log.Printf("reloading %s", s.ConfFile)
+	if err := s.reload(); err != nil {
+		log.Printf("reload rejected, keeping the current config: %s", err)
+	}
+}
+
+// watchConf signals on changed whenever the modification time of the config
+// file changes.
+func watchConf(path string, interval time.Duration, changed chan<- bool) {
+	modTime := func() time.Time {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}
+		}
+		return fi.ModTime()
+	}
+
+	last := modTime()
+	for range time.Tick(interval) {
+		if m := modTime(); !m.Equal(last) && !m.IsZero() {
+			last = m
+			select {
+			case changed <- true:
+			default: // a reload is pending anyway
+			}
+		}
+	}
+}
+
+type confChange struct {
+	path     string
+	from, to string // "" if not set
+	secret   bool   // read from a _file
+}
+
+func (c confChange) needsRestart() bool {
+	for _, s := range restartSettings {
+		if c.path == s || strings.HasPrefix(c.path, s+".") || strings.HasPrefix(c.path, s+"[") {
+			return true
+		}
+	}
+	return false
+}
+
+func (c confChange) String() string {
+	from, to := c.from, c.to
+	switch {
+	case c.secret || isSecretSetting(c.path):
+		from, to = maskSecret(from), maskSecret(to)
+	case strings.HasSuffix(c.path, ".dest") || strings.Contains(c.path, ".members["):
+		from, to = redactedDest(from), redactedDest(to)
+	}
+	switch {
+	case c.from == "":
+		return fmt.Sprintf("+ %s: %s", c.path, to)
+	case c.to == "":
+		return fmt.Sprintf("- %s: %s", c.path, from)
+	}
+	return fmt.Sprintf("~ %s: %s -> %s", c.path, from, to)
+}
+
+func isSecretSetting(path string) bool {
+	for _, s := range secretSettings {
+		if path == s || strings.HasSuffix(path, "."+s) {
+			return true
+		}
+	}
+	// e.g. request_headers.set.Authorization
+	return strings.HasSuffix(strings.ToLower(path), ".authorization")
+}
+
+func maskSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "********"
+}
+
+// confDiff returns the settings which differ between a and b, by their path
+// in the config file.
+func confDiff(a, b *Conf) []confChange {
+	before := make(map[string]string)
+	flattenConf(reflect.ValueOf(a).Elem(), "", before)
+	after := make(map[string]string)
+	flattenConf(reflect.ValueOf(b).Elem(), "", after)
+
+	var changes []confChange
+	for path, v := range before {
+		if after[path] != v {
+			changes = append(changes, confChange{path, v, after[path], a.secrets[path] || b.secrets[path]})
+		}
+	}
+	for path, v := range after {
+		if _, ok := before[path]; !ok {
+			changes = append(changes, confChange{path, "", v, b.secrets[path]})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].path < changes[j].path })
+	return changes
+}
+
+// flattenConf puts every setting of v which is set into values, named by the
+// yaml keys.
+func flattenConf(v reflect.Value, path string, values map[string]string) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			flattenConf(v.Elem(), path, values)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			name := strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			if path != "" {
+				name = path + "." + name
+			}
+			flattenConf(v.Field(i), name, values)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			flattenConf(v.Index(i), fmt.Sprintf("%s[%d]", path, i), values)
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			flattenConf(v.MapIndex(key), path+"."+fmt.Sprint(key.Interface()), values)
+		}
+	default:
+		if !v.IsZero() {
+			values[path] = fmt.Sprint(v.Interface())
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const reloadTestConf = `
+address: ":9999"
+auth:
+  session:
+    key: secret
+  info:
+    service: nothing
+    client_id: dummy
+    client_secret: dummy
+    redirect_url: "http://example.com/oauth2callback"
+proxy:
+  - path: /foo
+    dest: http://127.0.0.1:10001
+`
+
+func TestConfDiff(t *testing.T) {
+	a := &Conf{
+		Addr:         ":9999",
+		Auth:         AuthConf{Session: AuthSessionConf{Key: "old secret"}},
+		Restrictions: []string{"example.com"},
+		Proxies:      []ProxyConf{{Path: "/foo", Dest: "http://127.0.0.1:10001"}},
+	}
+	b := &Conf{
+		Addr:         ":9999",
+		Auth:         AuthConf{Session: AuthSessionConf{Key: "new secret"}},
+		Restrictions: []string{"example.com", "example.org"},
+		Proxies: []ProxyConf{{
+			Path:           "/foo",
+			Dest:           "http://127.0.0.1:10002",
+			RequestHeaders: HeaderConf{Set: map[string]string{"Authorization": "Bearer token"}},
+		}},
+	}
+
+	var lines []string
+	for _, c := range confDiff(a, b) {
+		lines = append(lines, c.String())
+	}
+	expected := []string{
+		"~ auth.session.key: ******** -> ********",
+		"~ proxy[0].dest: http://127.0.0.1:10001 -> http://127.0.0.1:10002",
+		"+ proxy[0].request_headers.set.Authorization: ********",
+		"+ restrictions[1]: example.org",
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected diff:\n%s", strings.Join(lines, "\n"))
+	}
+
+	if changes := confDiff(a, a); len(changes) != 0 {
+		t.Errorf("unexpected changes: %v", changes)
+	}
+	b.Listeners = []ListenerConf{{Address: ":80"}}
+	for _, c := range confDiff(a, b) {
+		if c.needsRestart() != strings.HasPrefix(c.path, "listeners") {
+			t.Errorf("%s: unexpected needsRestart", c.path)
+		}
+	}
+}
+
+func TestReloadRejected(t *testing.T) {
+	f, err := ioutil.TempFile("", "gate-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(reloadTestConf)
+	f.Close()
+
+	conf, err := ParseConf(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(conf)
+	s.ConfFile = f.Name()
+
+	if err := s.reload(); err != nil {
+		t.Errorf("unchanged config rejected: %s", err)
+	}
+
+	ioutil.WriteFile(f.Name(), []byte(strings.Replace(reloadTestConf, ":9999", ":8888", 1)), 0644)
+	if err := s.reload(); err == nil || !strings.Contains(err.Error(), "address") {
+		t.Errorf("address change not rejected: %v", err)
+	}
+
+	ioutil.WriteFile(f.Name(), []byte(reloadTestConf+"paths:\n  login: /signin\n"), 0644)
+	if err := s.reload(); err == nil || !strings.Contains(err.Error(), "paths.login") {
+		t.Errorf("paths change not rejected: %v", err)
+	}
+
+	ioutil.WriteFile(f.Name(), []byte(strings.Replace(reloadTestConf, "127.0.0.1:10001", "%%invalid", 1)), 0644)
+	if err := s.reload(); err == nil {
+		t.Error("invalid config accepted")
+	}
+	if s.Conf != conf {
+		t.Error("config replaced by a rejected one")
+	}
+}
+
+func TestReloadableHandler(t *testing.T) {
+	h := &reloadableHandler{}
+	h.set(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("old")) }))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Body.String() != "old" {
+		t.Errorf("unexpected body: %s", w.Body)
+	}
+
+	h.set(http.NotFoundHandler())
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("handler not swapped: %d", w.Code)
+	}
+
+	s := &Server{sessionKeys: []string{"new", "old"}}
+	pairs := s.sessionKeyPairs()
+	if len(pairs) != 4 || string(pairs[0]) != "new" || pairs[1] != nil || string(pairs[2]) != "old" {
+		t.Errorf("unexpected session keys: %q", pairs)
+	}
+}
+
+func TestWatchConf(t *testing.T) {
+	f, err := ioutil.TempFile("", "gate-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	changed := make(chan bool, 1)
+	go watchConf(f.Name(), 10*time.Millisecond, changed)
+	time.Sleep(50 * time.Millisecond)
+
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(f.Name(), later, later)
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Error("change not noticed")
+	}
+}
+
+func TestRotateSessionKeys(t *testing.T) {
+	keys := []string{"first"}
+	for _, step := range []struct {
+		key      string
+		expected []string
+	}{
+		{"first", []string{"first"}},
+		{"second", []string{"second", "first"}},
+		{"second", []string{"second", "first"}},
+		{"third", []string{"third", "second"}},
+	} {
+		keys = rotateSessionKeys(keys, step.key)
+		if strings.Join(keys, ",") != strings.Join(step.expected, ",") {
+			t.Errorf("%s: expected %v, got %v", step.key, step.expected, keys)
+		}
+	}
+}
+
+func TestProxyStateReused(t *testing.T) {
+	breakerConf := CircuitBreakerConf{ConsecutiveFailures: 3}
+	limitConf := RateLimitConf{Rate: "10/s"}
+
+	prev := newProxyState()
+	first := newProxyState()
+	cb, err := first.breaker(prev, "/api/", breakerConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := first.rateLimiter(prev, "/api/", limitConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := newProxyState()
+	if reused, _ := second.breaker(first, "/api/", breakerConf); reused != cb {
+		t.Errorf("unchanged breaker not reused")
+	}
+	if reused, _ := second.rateLimiter(first, "/api/", limitConf); reused != l {
+		t.Errorf("unchanged rate limiter not reused")
+	}
+	breakerConf.ConsecutiveFailures = 5
+	if changed, _ := second.breaker(first, "/api/", breakerConf); changed == cb {
+		t.Errorf("breaker reused after its settings changed")
+	}
+	if other, _ := second.rateLimiter(first, "/other/", limitConf); other == l {
+		t.Errorf("rate limiter reused for another proxy")
+	}
+}
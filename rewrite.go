@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var defaultRewriteTypes = []string{"text/html", "text/css"}
+
+// rewriteChunkSize is how much of the backend body is read at once. Together
+// with the small look-behind kept between reads it bounds the memory used per
+// rewritten response.
+const rewriteChunkSize = 32 * 1024
+
+// linkPattern matches the start of a root-relative reference: href="/, src=/,
+// action='/ and url(/ . The whitespace is bounded so a match never gets longer
+// than linkMaxMatch bytes.
+var linkPattern = regexp.MustCompile(`(?i)(?:(href|src|action)\s{0,8}=\s{0,8}["']?|url\(\s{0,8}["']?)/`)
+
+const linkMaxMatch = 32
+
+// rewriteResponse rewrites root-relative links in the response body so that
+// they point below the mount prefix of the backend.
+func (b *Backend) rewriteResponse(res *http.Response) error {
+	if !b.Strip {
+		return nil
+	}
+	prefix := strings.TrimSuffix(b.StripPath, "/")
+	if prefix == "" {
+		return nil
+	}
+
+	if res.Request != nil && res.Request.Method == "HEAD" {
+		return nil
+	}
+	if res.StatusCode == http.StatusNoContent || res.StatusCode == http.StatusNotModified {
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		return nil
+	}
+	matched := false
+	for _, t := range b.RewriteTypes {
+		if strings.EqualFold(t, mediaType) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return nil
+	}
+
+	body := res.Body
+	switch strings.ToLower(res.Header.Get("Content-Encoding")) {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		body = &gzipBody{body: res.Body}
+		res.Header.Del("Content-Encoding")
+	default:
+		// can't decode it, pass through untouched
+		return nil
+	}
+
+	res.Body = newLinkRewriter(body, prefix)
+	res.Header.Del("Content-Length")
+	res.Header.Del("Content-MD5")
+	res.ContentLength = -1
+	// the rewritten body is only equivalent to the backend's one
+	if etag := res.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		res.Header.Set("ETag", "W/"+etag)
+	}
+
+	return nil
+}
+
+// gzipBody decompresses the wrapped body. The gzip reader is created on the
+// first Read so that nothing is consumed before the body is actually used.
+type gzipBody struct {
+	body io.ReadCloser
+	zr   *gzip.Reader
+}
+
+func (g *gzipBody) Read(p []byte) (int, error) {
+	if g.zr == nil {
+		zr, err := gzip.NewReader(g.body)
+		if err != nil {
+			return 0, err
+		}
+		g.zr = zr
+	}
+	return g.zr.Read(p)
+}
+
+func (g *gzipBody) Close() error {
+	return g.body.Close()
+}
+
+// linkRewriter is a streaming io.ReadCloser inserting prefix in front of
+// root-relative links. Input is processed chunk by chunk; only a short tail is
+// held back between reads so that a link split across two reads is still found.
+type linkRewriter struct {
+	src    io.ReadCloser
+	prefix []byte
+	hold   int
+
+	in   []byte // input not processed yet
+	out  []byte // processed output not returned yet
+	prev byte   // last byte moved from in to out
+	eof  bool
+	err  error
+}
+
+func newLinkRewriter(src io.ReadCloser, prefix string) *linkRewriter {
+	hold := linkMaxMatch + len(prefix) + 2
+	return &linkRewriter{
+		src:    src,
+		prefix: []byte(prefix),
+		hold:   hold,
+		in:     make([]byte, 0, rewriteChunkSize+hold),
+	}
+}
+
+func (l *linkRewriter) Read(p []byte) (int, error) {
+	for len(l.out) == 0 {
+		if l.eof {
+			return 0, l.err
+		}
+		l.fill()
+		l.process()
+	}
+
+	n := copy(p, l.out)
+	l.out = l.out[n:]
+	return n, nil
+}
+
+func (l *linkRewriter) Close() error {
+	return l.src.Close()
+}
+
+func (l *linkRewriter) fill() {
+	start := len(l.in)
+	if cap(l.in)-start < rewriteChunkSize {
+		in := make([]byte, start, start+rewriteChunkSize)
+		copy(in, l.in)
+		l.in = in
+	}
+	n, err := l.src.Read(l.in[start : start+rewriteChunkSize])
+	l.in = l.in[:start+n]
+	if err != nil {
+		l.eof = true
+		l.err = err
+	}
+}
+
+// process moves everything except the held back tail from in to out.
+func (l *linkRewriter) process() {
+	cut := len(l.in)
+	if !l.eof {
+		cut -= l.hold
+		if cut <= 0 {
+			return
+		}
+	}
+
+	out := l.out[:0]
+	last := 0
+	for _, m := range linkPattern.FindAllSubmatchIndex(l.in, -1) {
+		if m[0] >= cut {
+			break
+		}
+		// attribute names must not be the tail of a longer word (e.g. "xsrc=")
+		if m[2] >= 0 {
+			before := l.prev
+			if m[2] > 0 {
+				before = l.in[m[2]-1]
+			}
+			if isWordByte(before) {
+				continue
+			}
+		}
+		slash := m[1] - 1
+		rest := l.in[slash:]
+		// protocol relative links (//host/...) point elsewhere
+		if len(rest) > 1 && rest[1] == '/' {
+			continue
+		}
+		// already below the prefix
+		if bytes.HasPrefix(rest, l.prefix) && (len(rest) == len(l.prefix) || isLinkEnd(rest[len(l.prefix)])) {
+			continue
+		}
+		out = append(out, l.in[last:slash]...)
+		out = append(out, l.prefix...)
+		last = slash
+		if m[1] > cut {
+			cut = m[1]
+		}
+	}
+	out = append(out, l.in[last:cut]...)
+	if cut > 0 {
+		l.prev = l.in[cut-1]
+	}
+
+	l.out = out
+	l.in = append(l.in[:0], l.in[cut:]...)
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+func isLinkEnd(c byte) bool {
+	return strings.IndexByte("/?#\"') \t\r\n>", c) >= 0
+}
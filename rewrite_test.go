@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+const rewriteInput = `<html><head>
+<link href="/static/app.css" rel="stylesheet">
+<script src='/static/app.js'></script>
+<script src="//cdn.example.com/lib.js"></script>
+<style>body { background: url( "/img/bg.png" ) }</style>
+</head><body>
+<form action=/login method="post"></form>
+<img data-src="/img/lazy.png" xsrc="/img/no.png">
+<a href="/kibana/app">already prefixed</a>
+<a href="https://example.com/">external</a>
+<a href="relative/path">relative</a>
+</body></html>`
+
+const rewriteExpected = `<html><head>
+<link href="/kibana/static/app.css" rel="stylesheet">
+<script src='/kibana/static/app.js'></script>
+<script src="//cdn.example.com/lib.js"></script>
+<style>body { background: url( "/kibana/img/bg.png" ) }</style>
+</head><body>
+<form action=/kibana/login method="post"></form>
+<img data-src="/kibana/img/lazy.png" xsrc="/img/no.png">
+<a href="/kibana/app">already prefixed</a>
+<a href="https://example.com/">external</a>
+<a href="relative/path">relative</a>
+</body></html>`
+
+func TestLinkRewriter(t *testing.T) {
+	// one byte at a time to hit every chunk boundary
+	r := newLinkRewriter(ioutil.NopCloser(iotest.OneByteReader(strings.NewReader(rewriteInput))), "/kibana")
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != rewriteExpected {
+		t.Errorf("unexpected rewrite result:\n%s", out)
+	}
+
+	// large body
+	input := strings.Repeat(rewriteInput, 1000)
+	r = newLinkRewriter(ioutil.NopCloser(strings.NewReader(input)), "/kibana")
+	out, err = ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != strings.Repeat(rewriteExpected, 1000) {
+		t.Errorf("unexpected rewrite result for large body")
+	}
+}
+
+func TestRewriteResponseGzip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(rewriteInput))
+	zw.Close()
+
+	b := &Backend{Strip: true, StripPath: "/kibana/", RewriteBody: true, RewriteTypes: defaultRewriteTypes}
+	res := &http.Response{
+		StatusCode:    200,
+		Header:        http.Header{},
+		Body:          ioutil.NopCloser(&buf),
+		ContentLength: int64(buf.Len()),
+		Request:       &http.Request{Method: "GET"},
+	}
+	res.Header.Set("Content-Type", "text/html; charset=utf-8")
+	res.Header.Set("Content-Encoding", "gzip")
+	res.Header.Set("Content-Length", "1234")
+	res.Header.Set("Content-MD5", "Q2hlY2sgSW50ZWdyaXR5IQ==")
+	res.Header.Set("ETag", `"abc"`)
+
+	if err := b.rewriteResponse(res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Header.Get("Content-Encoding") != "" || res.Header.Get("Content-Length") != "" || res.Header.Get("Content-MD5") != "" {
+		t.Errorf("unexpected headers: %v", res.Header)
+	}
+	if etag := res.Header.Get("ETag"); etag != `W/"abc"` {
+		t.Errorf("ETag not weakened: %s", etag)
+	}
+	out, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != rewriteExpected {
+		t.Errorf("unexpected rewrite result:\n%s", out)
+	}
+
+	// other content types are left alone
+	res = &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader(rewriteInput)),
+		Request:    &http.Request{Method: "GET"},
+	}
+	res.Header.Set("Content-Type", "application/json")
+	if err := b.rewriteResponse(res); err != nil {
+		t.Fatal(err)
+	}
+	out, _ = ioutil.ReadAll(res.Body)
+	if string(out) != rewriteInput {
+		t.Errorf("unexpected rewrite of application/json")
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/martini-contrib/oauth2"
+)
+
+// route is a proxy as the router sees it.
+type route struct {
+	index   int    // in the proxy list
+	pattern string // "/foo/**"
+	prefix  string // "/foo/", removed by strip_path
+	rawPath string // "/foo", redirected to prefix
+	proxy   ProxyConf
+}
+
+// routeTable returns the proxies grouped by path, in the order the router
+// tries the paths. The first route of a group redirects its rawPath.
+func routeTable(c *Conf) [][]route {
+	var groups [][]route
+	index := make(map[string]int)
+	for i, p := range c.Proxies {
+		pattern, prefix, rawPath := routePaths(p.Path)
+		r := route{i, pattern, prefix, rawPath, p}
+		if j, ok := index[pattern]; ok {
+			groups[j] = append(groups[j], r)
+			continue
+		}
+		index[pattern] = len(groups)
+		groups = append(groups, []route{r})
+	}
+	return groups
+}
+
+// routeForHost picks the route of a group like virtualHostProxy does: by
+// host, else the one without host, else the first one. Later routes for the
+// same host replace earlier ones.
+func routeForHost(group []route, host string) *route {
+	var exact, fallback *route
+	for i := range group {
+		switch group[i].proxy.Host {
+		case host:
+			exact = &group[i]
+		case "":
+			fallback = &group[i]
+		}
+	}
+	if exact != nil {
+		return exact
+	}
+	if fallback != nil {
+		return fallback
+	}
+	return &group[0]
+}
+
+type oauthRoute struct {
+	name, path string
+}
+
+// oauthRoutes are handled by the OAuth middleware before any route.
+func oauthRoutes() []oauthRoute {
+	return []oauthRoute{
+		{"login", oauth2.PathLogin},
+		{"logout", oauth2.PathLogout},
+		{"callback", oauth2.PathCallback},
+		{"error", oauth2.PathError},
+	}
+}
+
+func proxyOptions(p ProxyConf) string {
+	var options []string
+	if p.Strip {
+		options = append(options, "strip_path")
+	}
+	if p.HostHeader != "" && p.HostHeader != HostHeaderPreserve {
+		options = append(options, "host_header="+p.HostHeader)
+	}
+	if len(p.Members) > 0 {
+		options = append(options, fmt.Sprintf("members=%d", len(p.Members)))
+	}
+	if p.Protocol != "" {
+		options = append(options, "protocol="+p.Protocol)
+	}
+	if p.WebSocket.Upgrade == WebSocketDeny {
+		options = append(options, "websocket=deny")
+	}
+	if p.ClientCert != "" {
+		options = append(options, "client_cert="+p.ClientCert)
+	}
+	if p.RateLimit.Rate != "" {
+		options = append(options, "rate_limit="+p.RateLimit.Rate)
+	}
+	if p.MaxBodySize != "" {
+		options = append(options, "max_body_size="+p.MaxBodySize)
+	}
+	if p.RewriteBody {
+		options = append(options, "rewrite_body")
+	}
+	return strings.Join(options, ", ")
+}
+
+// printRoutes prints the routing table in the order routes are matched.
+func printRoutes(w io.Writer, c *Conf) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+
+	fmt.Fprintln(tw, "HOST\tPATH\tDEST\tOPTIONS")
+	if c.Auth.Info.Service != noAuthServiceName {
+		for _, r := range oauthRoutes() {
+			fmt.Fprintf(tw, "*\t%s\t(oauth %s)\t\n", r.path, r.name)
+		}
+	}
+	if c.Admin.Path != "" {
+		fmt.Fprintf(tw, "*\t%s/vars\t(admin)\tGET\n", c.Admin.Path)
+		fmt.Fprintf(tw, "*\t%s/backends\t(admin)\tGET\n", c.Admin.Path)
+	}
+	for _, group := range routeTable(c) {
+		for _, r := range group {
+			host := r.proxy.Host
+			if host == "" {
+				host = "*"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", host, r.prefix, redactedDest(r.proxy.Dest), proxyOptions(r.proxy))
+		}
+		if group[0].rawPath != "" {
+			fmt.Fprintf(tw, "*\t%s\t(redirect to %s)\tGET\n", group[0].rawPath, group[0].prefix)
+		}
+	}
+	fmt.Fprintf(tw, "*\t/\t(static files in %s)\tGET\n", c.Htdocs)
+}
+
+// printMatch shows which route, backend and policy a request for rawurl
+// would get.
+func printMatch(w io.Writer, c *Conf, rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" {
+		return fmt.Errorf("not an absolute URL: %s", rawurl)
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 1, ' ', 0)
+	defer tw.Flush()
+
+	if c.Auth.Info.Service != noAuthServiceName {
+		for _, r := range oauthRoutes() {
+			if u.Path == r.path {
+				fmt.Fprintf(tw, "route:\toauth %s\n", r.name)
+				return nil
+			}
+		}
+	}
+	if c.Admin.Path != "" && (u.Path == c.Admin.Path+"/vars" || u.Path == c.Admin.Path+"/backends") {
+		fmt.Fprintf(tw, "route:\tadmin endpoint (GET)\n")
+		printAuth(tw, c, nil)
+		return nil
+	}
+
+	for _, group := range routeTable(c) {
+		if strings.HasPrefix(u.Path, group[0].prefix) {
+			r := routeForHost(group, u.Host)
+			printRoute(tw, c, r, u)
+			return nil
+		}
+		if u.Path == group[0].rawPath {
+			fmt.Fprintf(tw, "route:\tredirect to %s (GET)\n", group[0].prefix)
+			printAuth(tw, c, nil)
+			return nil
+		}
+	}
+
+	fmt.Fprintf(tw, "route:\tstatic files in %s (GET)\n", c.Htdocs)
+	printAuth(tw, c, nil)
+	return nil
+}
+
+func printRoute(w io.Writer, c *Conf, r *route, u *url.URL) {
+	p := r.proxy
+	host := p.Host
+	if host == "" {
+		host = "*"
+	}
+	fmt.Fprintf(w, "route:\tproxy[%d] host %s path %s\n", r.index, host, r.prefix)
+	fmt.Fprintf(w, "dest:\t%s\n", redactedDest(p.Dest))
+	for _, m := range p.Members {
+		fmt.Fprintf(w, "member:\t%s\n", redactedDest(m))
+	}
+
+	dest, _, prefix, err := parseDest(p.Dest)
+	if err == nil {
+		b := &Backend{URL: dest, Strip: p.Strip, StripPath: r.prefix, PathPrefix: prefix}
+		upstream := *u
+		b.rewriteURL(&upstream)
+		fmt.Fprintf(w, "upstream url:\t%s\n", upstream.String())
+	}
+	if options := proxyOptions(p); options != "" {
+		fmt.Fprintf(w, "options:\t%s\n", options)
+	}
+	printAuth(w, c, &p)
+
+	websocket := "allowed"
+	if p.WebSocket.Upgrade == WebSocketDeny {
+		websocket = "denied"
+	}
+	fmt.Fprintf(w, "websocket:\t%s\n", websocket)
+
+	var limits []string
+	if c.RateLimit.Rate != "" {
+		limits = append(limits, "global "+c.RateLimit.Rate)
+	}
+	if p.RateLimit.Rate != "" {
+		limits = append(limits, "route "+p.RateLimit.Rate)
+	}
+	if len(limits) > 0 {
+		fmt.Fprintf(w, "rate limit:\t%s\n", strings.Join(limits, ", "))
+	}
+	maxBodySize := p.MaxBodySize
+	if maxBodySize == "" {
+		maxBodySize = c.MaxBodySize
+	}
+	if maxBodySize != "" {
+		fmt.Fprintf(w, "max body size:\t%s\n", maxBodySize)
+	}
+}
+
+// printAuth shows who is let in, for p or for routes which aren't proxies.
+func printAuth(w io.Writer, c *Conf, p *ProxyConf) {
+	auth := "none"
+	if c.Auth.Info.Service != noAuthServiceName {
+		auth = "OAuth (" + c.Auth.Info.Service + ")"
+		if c.SSL.ClientCA != "" {
+			if p != nil && p.ClientCert == ClientCertRequired {
+				auth += " and client certificate"
+			} else {
+				auth = "client certificate or " + auth
+			}
+		}
+	}
+	fmt.Fprintf(w, "auth:\t%s\n", auth)
+	if len(c.Restrictions) > 0 && c.Auth.Info.Service != noAuthServiceName {
+		fmt.Fprintf(w, "restrictions:\t%s\n", strings.Join(c.Restrictions, ", "))
+	}
+	if len(c.SSL.ClientRestrictions) > 0 {
+		fmt.Fprintf(w, "client restrictions:\t%s\n", strings.Join(c.SSL.ClientRestrictions, ", "))
+	}
+}
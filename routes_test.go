@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/martini-contrib/oauth2"
+)
+
+const routesTestConf = `
+address: ":9999"
+auth:
+  session:
+    key: secret
+  info:
+    service: google
+    client_id: dummy
+    client_secret: dummy
+    redirect_url: https://gate.example.com/oauth2callback
+admin:
+  path: /_gate
+rate_limit:
+  rate: 100/s
+proxy:
+  - path: /es
+    dest: http://127.0.0.1:9200
+    strip_path: yes
+  - path: /es
+    host: search.example.com
+    dest: unix:///run/es.sock:/v2
+    max_body_size: 1MB
+  - path: /ws/
+    dest: http://127.0.0.1:8080
+    websocket:
+      upgrade: deny
+`
+
+// defaultOAuthPaths resets the paths other tests may have changed.
+func defaultOAuthPaths() {
+	oauth2.PathLogin = "/login"
+	oauth2.PathLogout = "/logout"
+	oauth2.PathCallback = "/oauth2callback"
+	oauth2.PathError = "/oauth2error"
+}
+
+func TestRoutes(t *testing.T) {
+	defaultOAuthPaths()
+	conf := writeTestConf(t, routesTestConf)
+	defer os.Remove(conf)
+
+	var out bytes.Buffer
+	if status := routesCommand(conf, nil, &out); status != 0 {
+		t.Fatalf("routes failed: %s", out.String())
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	var routes []string
+	for _, line := range lines {
+		routes = append(routes, strings.Join(strings.Fields(line), " "))
+	}
+	expected := []string{
+		"HOST PATH DEST OPTIONS",
+		"* /login (oauth login)",
+		"* /logout (oauth logout)",
+		"* /oauth2callback (oauth callback)",
+		"* /oauth2error (oauth error)",
+		"* /_gate/vars (admin) GET",
+		"* /_gate/backends (admin) GET",
+		"* /es/ http://127.0.0.1:9200 strip_path",
+		"search.example.com /es/ unix:///run/es.sock:/v2 max_body_size=1MB",
+		"* /es (redirect to /es/) GET",
+		"* /ws/ http://127.0.0.1:8080 websocket=deny",
+		"* / (static files in .) GET",
+	}
+	if strings.Join(routes, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected routes:\n%s", out.String())
+	}
+}
+
+func TestMatch(t *testing.T) {
+	defaultOAuthPaths()
+	conf := writeTestConf(t, routesTestConf)
+	defer os.Remove(conf)
+
+	tests := []struct {
+		url      string
+		expected []string
+	}{
+		{"https://gate.example.com/es/_search?q=1", []string{
+			"route: proxy[0] host * path /es/",
+			"upstream url: http://127.0.0.1:9200/_search?q=1",
+			"auth: OAuth (google)",
+			"rate limit: global 100/s",
+		}},
+		{"https://search.example.com/es/_search", []string{
+			"route: proxy[1] host search.example.com path /es/",
+			"upstream url: http://localhost/v2/es/_search",
+			"max body size: 1MB",
+		}},
+		{"https://gate.example.com/es", []string{"route: redirect to /es/ (GET)"}},
+		{"https://gate.example.com/ws/chat", []string{"websocket: denied"}},
+		{"https://gate.example.com/_gate/vars", []string{"route: admin endpoint (GET)"}},
+		{"https://gate.example.com/login", []string{"route: oauth login"}},
+		{"https://gate.example.com/index.html", []string{"route: static files in . (GET)"}},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		if status := matchCommand(conf, []string{test.url}, &out); status != 0 {
+			t.Errorf("%s: match failed: %s", test.url, out.String())
+			continue
+		}
+		var lines []string
+		for _, line := range strings.Split(out.String(), "\n") {
+			lines = append(lines, strings.Join(strings.Fields(line), " "))
+		}
+		normalized := strings.Join(lines, "\n")
+		for _, e := range test.expected {
+			if !strings.Contains(normalized, e) {
+				t.Errorf("%s: %q missing from:\n%s", test.url, e, out.String())
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	if status := matchCommand(conf, []string{"/es/"}, &out); status == 0 {
+		t.Error("relative URL accepted")
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import "reflect"
+
+// envSchema accepts ${VAR} where a setting isn't a string.
+var envSchema = map[string]interface{}{
+	"type":    "string",
+	"pattern": `^\$\{[A-Za-z_][A-Za-z0-9_]*\}$`,
+}
+
+// confSchema returns a JSON Schema of the config file, generated from the
+// yaml keys of Conf, so editors can validate and complete configs.
+func confSchema() map[string]interface{} {
+	schema := typeSchema(reflect.TypeOf(Conf{}))
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "gate config"
+	return schema
+}
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		fields := yamlFields(t)
+		properties := make(map[string]interface{})
+		for name, ft := range fields {
+			properties[name] = typeSchema(ft)
+			if setting, ok := fileSetting(fields, name+"_file"); ok {
+				properties[name+"_file"] = map[string]interface{}{
+					"type":        "string",
+					"description": "file to read " + setting + " from",
+				}
+			}
+		}
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": typeSchema(t.Elem()),
+		}
+	case reflect.Slice:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": typeSchema(t.Elem()),
+		}
+	case reflect.Bool:
+		return map[string]interface{}{
+			"anyOf": []interface{}{
+				map[string]interface{}{"type": "boolean"},
+				// yaml 1.1 bools, see yamlBools
+				map[string]interface{}{"enum": []string{
+					"y", "Y", "yes", "Yes", "YES", "n", "N", "no", "No", "NO",
+					"on", "On", "ON", "off", "Off", "OFF",
+				}},
+				envSchema,
+			},
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{
+			"anyOf": []interface{}{map[string]interface{}{"type": "integer"}, envSchema},
+		}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{
+			"anyOf": []interface{}{map[string]interface{}{"type": "number"}, envSchema},
+		}
+	}
+	return map[string]interface{}{"type": "string"}
+}
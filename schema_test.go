@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"testing"
+)
+
+// schemaKeys returns the keys of v which the schema doesn't allow.
+func schemaKeys(v interface{}, schema map[string]interface{}, path string) []string {
+	var unknown []string
+	switch value := v.(type) {
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+		for k, item := range value {
+			if s, ok := properties[k].(map[string]interface{}); ok {
+				unknown = append(unknown, schemaKeys(item, s, joinPath(path, k))...)
+			} else if s, ok := schema["additionalProperties"].(map[string]interface{}); ok {
+				unknown = append(unknown, schemaKeys(item, s, joinPath(path, k))...)
+			} else {
+				unknown = append(unknown, joinPath(path, k))
+			}
+		}
+	case []interface{}:
+		items, _ := schema["items"].(map[string]interface{})
+		for i, item := range value {
+			unknown = append(unknown, schemaKeys(item, items, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return unknown
+}
+
+func TestConfSchema(t *testing.T) {
+	var out bytes.Buffer
+	if status := schemaCommand("", nil, &out); status != 0 {
+		t.Fatalf("schema failed: %s", out.String())
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &schema); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile("config_sample.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sample interface{}
+	if err := yaml.Unmarshal(data, &sample); err != nil {
+		t.Fatal(err)
+	}
+	if unknown := schemaKeys(sample, schema, ""); len(unknown) > 0 {
+		t.Errorf("sample config keys not in the schema: %v", unknown)
+	}
+	if unknown := schemaKeys(map[string]interface{}{"restriction": nil}, schema, ""); len(unknown) != 1 {
+		t.Errorf("unknown key allowed by the schema")
+	}
+
+	info := schema["properties"].(map[string]interface{})["auth"].(map[string]interface{})["properties"].(map[string]interface{})["info"].(map[string]interface{})["properties"].(map[string]interface{})
+	if _, ok := info["client_secret_file"]; !ok {
+		t.Errorf("client_secret_file not in the schema")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// hstsPreloadMinAge is the minimum max-age accepted by the HSTS preload list.
+const hstsPreloadMinAge = 31536000
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519":         tls.X25519,
+	"X25519MLKEM768": tls.X25519MLKEM768,
+	"P-256":          tls.CurveP256,
+	"P-384":          tls.CurveP384,
+	"P-521":          tls.CurveP521,
+}
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+	suites := make(map[string]*tls.CipherSuite)
+	for _, s := range tls.CipherSuites() {
+		suites[s.Name] = s
+	}
+
+	var ids []uint16
+	for _, name := range names {
+		s, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite: %s", name)
+		}
+		if len(s.SupportedVersions) == 1 && s.SupportedVersions[0] == tls.VersionTLS13 {
+			return nil, fmt.Errorf("TLS 1.3 cipher suites can't be configured: %s", name)
+		}
+		ids = append(ids, s.ID)
+	}
+	return ids, nil
+}
+
+func hasHTTP2CipherSuite(ids []uint16) bool {
+	for _, id := range ids {
+		if id == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || id == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCurves(names []string) ([]tls.CurveID, error) {
+	var curves []tls.CurveID
+	for _, name := range names {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve: %s (must be one of X25519, X25519MLKEM768, P-256, P-384 or P-521)", name)
+		}
+		curves = append(curves, curve)
+	}
+	return curves, nil
+}
+
+// configureServerTLS applies min_version, cipher_suites, curves,
+// session_tickets and the client certificate settings to the TLS config of
+// the listener.
+func configureServerTLS(config *tls.Config, c SSLConf) error {
+	minVersion, err := parseTLSVersion("ssl.min_version", c.MinVersion)
+	if err != nil {
+		return err
+	}
+	if minVersion != 0 {
+		config.MinVersion = minVersion
+	}
+	if config.CipherSuites, err = parseCipherSuites(c.CipherSuites); err != nil {
+		return fmt.Errorf("ssl.cipher_suites: %s", err)
+	}
+	if len(config.CipherSuites) > 0 && !hasHTTP2CipherSuite(config.CipherSuites) {
+		return errors.New("ssl.cipher_suites: HTTP/2 needs TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256")
+	}
+	if config.CurvePreferences, err = parseCurves(c.Curves); err != nil {
+		return fmt.Errorf("ssl.curves: %s", err)
+	}
+	if c.SessionTickets != nil && !*c.SessionTickets {
+		config.SessionTicketsDisabled = true
+	}
+	if config.ClientCAs, config.ClientAuth, err = loadClientCAs(c); err != nil {
+		return err
+	}
+	return nil
+}
+
+// newHSTSHeader returns the Strict-Transport-Security header value for
+// ssl.hsts, or "" if it's not enabled.
+func newHSTSHeader(c HSTSConf) (string, error) {
+	if c.MaxAge == 0 {
+		if c.IncludeSubDomains || c.Preload {
+			return "", errors.New("ssl.hsts.max_age is required")
+		}
+		return "", nil
+	}
+	if c.MaxAge < 0 {
+		return "", errors.New("ssl.hsts.max_age must not be negative")
+	}
+	if c.Preload && (!c.IncludeSubDomains || c.MaxAge < hstsPreloadMinAge) {
+		return "", fmt.Errorf("ssl.hsts.preload needs include_subdomains and a max_age of at least %d", hstsPreloadMinAge)
+	}
+
+	parts := []string{fmt.Sprintf("max-age=%d", c.MaxAge)}
+	if c.IncludeSubDomains {
+		parts = append(parts, "includeSubDomains")
+	}
+	if c.Preload {
+		parts = append(parts, "preload")
+	}
+	return strings.Join(parts, "; "), nil
+}
+
+// hstsHandler adds the Strict-Transport-Security header to responses to
+// requests received over TLS.
+func hstsHandler(value string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
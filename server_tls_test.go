@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestConfigureServerTLS(t *testing.T) {
+	disabled := false
+	config := &tls.Config{}
+	err := configureServerTLS(config, SSLConf{
+		MinVersion:     "1.2",
+		CipherSuites:   []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"},
+		Curves:         []string{"X25519", "P-256"},
+		SessionTickets: &disabled,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MinVersion != tls.VersionTLS12 ||
+		len(config.CipherSuites) != 2 || config.CipherSuites[1] != tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256 ||
+		len(config.CurvePreferences) != 2 || config.CurvePreferences[0] != tls.X25519 ||
+		!config.SessionTicketsDisabled {
+		t.Errorf("unexpected config: %+v", config)
+	}
+
+	tests := []SSLConf{
+		{MinVersion: "1.4"},
+		{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		{CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}},
+		{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"}},
+		{Curves: []string{"P-224"}},
+	}
+	for i, c := range tests {
+		if err := configureServerTLS(&tls.Config{}, c); err == nil {
+			t.Errorf("test %d: no error", i)
+		}
+	}
+}
+
+func TestServerMinVersion(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{}
+	if err := configureServerTLS(server.TLS, SSLConf{MinVersion: "1.3"}); err != nil {
+		t.Fatal(err)
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	client := server.Client()
+	transport := client.Transport.(*http.Transport)
+	transport.TLSClientConfig.MaxVersion = tls.VersionTLS12
+	if _, err := client.Get(server.URL); err == nil {
+		t.Error("TLS 1.2 accepted")
+	}
+	transport.TLSClientConfig.MaxVersion = 0
+	if _, err := client.Get(server.URL); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHSTS(t *testing.T) {
+	tests := []struct {
+		conf   HSTSConf
+		header string
+		ok     bool
+	}{
+		{HSTSConf{}, "", true},
+		{HSTSConf{MaxAge: 86400}, "max-age=86400", true},
+		{HSTSConf{MaxAge: 31536000, IncludeSubDomains: true, Preload: true}, "max-age=31536000; includeSubDomains; preload", true},
+		{HSTSConf{IncludeSubDomains: true}, "", false},
+		{HSTSConf{MaxAge: -1}, "", false},
+		{HSTSConf{MaxAge: 86400, IncludeSubDomains: true, Preload: true}, "", false},
+		{HSTSConf{MaxAge: 31536000, Preload: true}, "", false},
+	}
+	for i, test := range tests {
+		header, err := newHSTSHeader(test.conf)
+		if (err == nil) != test.ok || header != test.header {
+			t.Errorf("test %d: unexpected result %q, %v", i, header, err)
+		}
+	}
+
+	handler := hstsHandler("max-age=86400", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+	res, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.Header.Get("Strict-Transport-Security") != "max-age=86400" {
+		t.Errorf("HSTS header missing: %v", res.Header)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://gate.example.com/", nil))
+	if w.Header().Get("Strict-Transport-Security") != "" {
+		t.Error("HSTS header sent over plain HTTP")
+	}
+}
+
+// newTestCA returns a new CA certificate and its key.
+func newTestCA(t *testing.T) (*x509.Certificate, crypto.Signer) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+	return ca, key
+}
+
+// issueTestCertificate returns a certificate for template issued by ca.
+func issueTestCertificate(t *testing.T, template *x509.Certificate, ca *x509.Certificate, caKey crypto.Signer) tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der, ca.Raw}, PrivateKey: key}
+}
+
+// writeTestChain writes a certificate issued by a new CA, naming responder
+// as OCSP server, and returns it with the CA.
+func writeTestChain(t *testing.T, dir, responder string) (CertificateConf, *x509.Certificate, crypto.Signer) {
+	ca, caKey := newTestCA(t)
+	cert := issueTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "gate.example.com"},
+		DNSNames:     []string{"gate.example.com"},
+		OCSPServer:   []string{responder},
+	}, ca, caKey)
+	keyDER, _ := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+
+	c := CertificateConf{Cert: filepath.Join(dir, "chain.crt"), Key: filepath.Join(dir, "chain.key")}
+	chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})...)
+	ioutil.WriteFile(c.Cert, chain, 0644)
+	ioutil.WriteFile(c.Key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return c, ca, caKey
+}
+
+func TestOCSPStapling(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gate-ocsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var ca *x509.Certificate
+	var caKey crypto.Signer
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		res, err := ocsp.CreateResponse(ca, ca, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}, caKey)
+		if err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(res)
+	}))
+	defer responder.Close()
+
+	var pair CertificateConf
+	pair, ca, caKey = writeTestChain(t, dir, responder.URL)
+	s, err := newCertificateStore(SSLConf{Cert: pair.Cert, Key: pair.Key, OCSPStapling: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.checked = time.Time{}
+	s.getCertificate(&tls.ClientHelloInfo{ServerName: "gate.example.com"})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cert, _ := s.getCertificate(&tls.ClientHelloInfo{ServerName: "gate.example.com"})
+		if cert.OCSPStaple != nil {
+			if _, err := ocsp.ParseResponse(cert.OCSPStaple, ca); err != nil {
+				t.Error(err)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no OCSP staple")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.mu.Lock()
+	refresh := s.certs[0].ocspRefresh
+	s.mu.Unlock()
+	if d := time.Until(refresh); d < 20*time.Minute || d > 31*time.Minute {
+		t.Errorf("unexpected refresh in %s", d)
+	}
+}
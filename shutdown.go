@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+func shutdownTimeout(c ServerConf) (time.Duration, error) {
+	timeout, err := parseDuration("shutdown_timeout", c.ShutdownTimeout)
+	if err != nil {
+		return 0, err
+	}
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
+	return timeout, nil
+}
+
+// wait serves until a server fails or a signal stops gate. SIGTERM and
+// SIGINT shut down gracefully; SIGUSR2 first hands the listeners over to a
+// new gate process, for binary upgrades without downtime. SIGHUP and, with
+// reload.watch, changes of the config file reload the config.
+func (s *Server) wait(servers []*http.Server, confs []ListenerConf, listeners []net.Listener, errs chan error) error {
+	timeout, err := shutdownTimeout(s.Conf.Server)
+	if err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	changed := make(chan bool, 1)
+	if s.Conf.Reload.Watch && s.ConfFile != "" {
+		interval, err := parseDuration("reload.interval", s.Conf.Reload.Interval)
+		if err != nil {
+			return err
+		}
+		if interval == 0 {
+			interval = defaultReloadInterval
+		}
+		log.Printf("watching %s for changes", s.ConfFile)
+		go watchConf(s.ConfFile, interval, changed)
+	}
+
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case <-changed:
+			s.logReload()
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				s.logReload()
+				continue
+			}
+			if sig == syscall.SIGUSR2 {
+				pid, err := handOver(confs, listeners)
+				if err != nil {
+					log.Printf("handing over to a new process failed, still serving: %s", err)
+					continue
+				}
+				log.Printf("listeners handed over to process %d", pid)
+			}
+			log.Printf("%s received, shutting down", sig)
+			return shutdown(servers, timeout)
+		}
+	}
+}
+
+// shutdown stops accepting connections, lets active requests finish and
+// closes WebSocket tunnels. Whatever is left after timeout is cut off.
+func shutdown(servers []*http.Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan error, len(servers)+1)
+	for _, server := range servers {
+		go func(server *http.Server) {
+			done <- server.Shutdown(ctx)
+		}(server)
+	}
+	go func() {
+		tunnels.goAway(ctx)
+		done <- ctx.Err()
+	}()
+
+	var err error
+	for i := 0; i < len(servers)+1; i++ {
+		if e := <-done; e != nil && err == nil {
+			err = e
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("connections still active after %s, closing them", timeout)
+		for _, server := range servers {
+			server.Close()
+		}
+		return nil
+	}
+	if err == nil {
+		log.Printf("shutdown complete")
+	}
+	return err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testTunnels replaces the tunnels, which can't be used after a shutdown.
+func testTunnels() func() {
+	old := tunnels
+	tunnels = &tunnelSet{tunnels: make(map[*websocketTunnel]struct{})}
+	return func() { tunnels = old }
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	defer testTunnels()()
+
+	started := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))
+	defer server.Close()
+
+	result := make(chan string, 1)
+	go func() {
+		res, err := http.Get(server.URL)
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		result <- string(body)
+	}()
+	<-started
+
+	if err := shutdown([]*http.Server{server.Config}, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if body := <-result; body != "done" {
+		t.Errorf("active request not drained: %s", body)
+	}
+	if _, err := http.Get(server.URL); err == nil {
+		t.Error("connection accepted after shutdown")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	defer testTunnels()()
+
+	started := make(chan bool)
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	failed := make(chan error, 1)
+	go func() {
+		_, err := http.Get(server.URL)
+		failed <- err
+	}()
+	<-started
+
+	begin := time.Now()
+	if err := shutdown([]*http.Server{server.Config}, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(begin); d > 2*time.Second {
+		t.Errorf("shutdown took %s", d)
+	}
+	if err := <-failed; err == nil {
+		t.Error("request not cut off")
+	}
+
+	if _, err := shutdownTimeout(ServerConf{ShutdownTimeout: "soon"}); err == nil {
+		t.Error("invalid shutdown_timeout accepted")
+	}
+	if d, _ := shutdownTimeout(ServerConf{}); d != defaultShutdownTimeout {
+		t.Errorf("unexpected default: %s", d)
+	}
+}
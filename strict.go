@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"reflect"
+	"strings"
+)
+
+// yaml 1.1 bools, which yaml.v3 still decodes into bool settings
+var yamlBools = map[string]bool{
+	"y": true, "yes": true, "on": true,
+	"n": true, "no": true, "off": true,
+}
+
+var yamlTypeNames = map[string]string{
+	"!!str":   "a string",
+	"!!int":   "an integer",
+	"!!float": "a number",
+	"!!bool":  "a bool",
+}
+
+// decodeConf decodes a config after interpolating environment variables and
+// reading the _file variants of settings. Unknown keys and values of the
+// wrong type are returned as problems, with their line numbers.
+func decodeConf(data []byte) (*Conf, []string, error) {
+	c := &Conf{secrets: make(map[string]bool)}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, nil, err
+	}
+	if root.Kind == 0 {
+		return c, nil, nil // empty file
+	}
+
+	t := reflect.TypeOf(c).Elem()
+	if err := resolveConf(&root, t, "", c.secrets); err != nil {
+		return nil, nil, err
+	}
+	problems := checkNode(&root, t, "", c.secrets)
+	if err := root.Decode(c); err != nil {
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok {
+			return nil, nil, err
+		}
+		if len(problems) == 0 {
+			problems = typeErr.Errors
+		}
+	}
+	return c, problems, nil
+}
+
+// checkNode returns the keys of n which t has no field for and the values
+// which can't be decoded into t. The values of secrets aren't shown.
+func checkNode(n *yaml.Node, t reflect.Type, path string, secrets map[string]bool) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	if n.Kind == yaml.DocumentNode {
+		return checkNode(n.Content[0], t, path, secrets)
+	}
+	if n.Kind == yaml.ScalarNode && n.ShortTag() == "!!null" {
+		return nil
+	}
+
+	var problems []string
+	switch t.Kind() {
+	case reflect.Struct:
+		if n.Kind != yaml.MappingNode {
+			return []string{typeProblem(n, path, "a mapping", secrets[path])}
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			if key.Value == "<<" {
+				problems = append(problems, checkNode(value, t, path, secrets)...)
+				continue
+			}
+			ft, ok := fields[key.Value]
+			if !ok {
+				problem := fmt.Sprintf("line %d: unknown key: %s", key.Line, joinPath(path, key.Value))
+				if s := suggestKey(fields, key.Value); s != "" {
+					problem += fmt.Sprintf(" (did you mean %s?)", s)
+				}
+				problems = append(problems, problem)
+				continue
+			}
+			problems = append(problems, checkNode(value, ft, joinPath(path, key.Value), secrets)...)
+		}
+	case reflect.Map:
+		if n.Kind != yaml.MappingNode {
+			return []string{typeProblem(n, path, "a mapping", secrets[path])}
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			problems = append(problems, checkNode(n.Content[i+1], t.Elem(), joinPath(path, n.Content[i].Value), secrets)...)
+		}
+	case reflect.Slice:
+		if n.Kind != yaml.SequenceNode {
+			return []string{typeProblem(n, path, "a list", secrets[path])}
+		}
+		for i, c := range n.Content {
+			problems = append(problems, checkNode(c, t.Elem(), fmt.Sprintf("%s[%d]", path, i), secrets)...)
+		}
+	case reflect.String:
+		if n.Kind != yaml.ScalarNode {
+			return []string{typeProblem(n, path, "a single value", secrets[path])}
+		}
+	case reflect.Bool:
+		if n.Kind != yaml.ScalarNode || (n.ShortTag() != "!!bool" && !yamlBools[strings.ToLower(n.Value)]) {
+			return []string{typeProblem(n, path, "true or false", secrets[path])}
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n.Kind != yaml.ScalarNode || n.ShortTag() != "!!int" {
+			return []string{typeProblem(n, path, "a whole number", secrets[path])}
+		}
+	case reflect.Float32, reflect.Float64:
+		if n.Kind != yaml.ScalarNode || (n.ShortTag() != "!!int" && n.ShortTag() != "!!float") {
+			return []string{typeProblem(n, path, "a number", secrets[path])}
+		}
+	}
+	return problems
+}
+
+func typeProblem(n *yaml.Node, path, expected string, secret bool) string {
+	var got string
+	switch {
+	case n.Kind == yaml.MappingNode:
+		got = "a mapping"
+	case n.Kind == yaml.SequenceNode:
+		got = "a list"
+	case secret:
+		// from the environment or a file, only the type is shown
+		got = yamlTypeNames[n.ShortTag()]
+		if got == "" {
+			got = "a " + n.ShortTag()
+		}
+	default:
+		got = fmt.Sprintf("%q", n.Value)
+	}
+	return fmt.Sprintf("line %d: %s: expected %s, got %s", n.Line, path, expected, got)
+}
+
+// suggestKey returns the field a misspelled key was probably meant to be.
+func suggestKey(fields map[string]reflect.Type, key string) string {
+	normalized := strings.ToLower(strings.Replace(key, "-", "_", -1))
+	best, bestDistance := "", 3
+	for name := range fields {
+		if name == normalized {
+			return name
+		}
+		d := editDistance(normalized, name)
+		if d < bestDistance || (d == bestDistance && name < best) {
+			best, bestDistance = name, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance of a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
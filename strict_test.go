@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeConfStrict(t *testing.T) {
+	c, problems, err := decodeConf([]byte(`
+address: ":9999"
+restriction:
+  - example.com
+auth:
+  session:
+    key: secret
+  info:
+    service: github
+proxy:
+  - path: /
+    dest: http://127.0.0.1:8080
+    strip-path: yes
+    retry:
+      attempts: three
+  - path: /api
+    dest: http://127.0.0.1:8081
+    strip_path: yes
+    websocket: deny
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"line 3: unknown key: restriction (did you mean restrictions?)",
+		"line 13: unknown key: proxy[0].strip-path (did you mean strip_path?)",
+		`line 15: proxy[0].retry.attempts: expected a whole number, got "three"`,
+		`line 19: proxy[1].websocket: expected a mapping, got "deny"`,
+	}
+	if strings.Join(problems, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected problems:\n%s", strings.Join(problems, "\n"))
+	}
+	if c.Addr != ":9999" || !c.Proxies[1].Strip {
+		t.Errorf("valid settings not decoded: %+v", c)
+	}
+}
+
+func TestDecodeConfTypes(t *testing.T) {
+	os.Setenv("GATE_TEST_RETRIES", "3")
+	defer os.Unsetenv("GATE_TEST_RETRIES")
+
+	c, problems, err := decodeConf([]byte(`
+auth:
+  session:
+    key: 12345
+proxy:
+  - path: /
+    dest: http://127.0.0.1:8080
+    strip_path: on
+    retry:
+      attempts: "${GATE_TEST_RETRIES}"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) > 0 {
+		t.Fatalf("unexpected problems:\n%s", strings.Join(problems, "\n"))
+	}
+	if c.Auth.Session.Key != "12345" || !c.Proxies[0].Strip || c.Proxies[0].Retry.Attempts != 3 {
+		t.Errorf("unexpected conf: %+v", c)
+	}
+}
+
+func TestSuggestKey(t *testing.T) {
+	fields := yamlFields(reflect.TypeOf(Conf{}))
+	for key, expected := range map[string]string{
+		"adress":        "address",
+		"Restrictions":  "restrictions",
+		"max-body-size": "max_body_size",
+		"proxies":       "",
+		"completely":    "",
+	} {
+		if s := suggestKey(fields, key); s != expected {
+			t.Errorf("%s: expected %q, got %q", key, expected, s)
+		}
+	}
+}
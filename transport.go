@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultDialTimeout  = 30 * time.Second
+	defaultRetryBackoff = 100 * time.Millisecond
+)
+
+// upstreamOptions tune the connections to a backend.
+type upstreamOptions struct {
+	dialTimeout           time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+	overallTimeout        time.Duration
+
+	retries      int
+	retryBackoff time.Duration
+
+	// hosts of dest and the members of the route, requests are balanced
+	// over them round robin
+	members []string
+
+	maxIdleConnsPerHost int
+	maxConnsPerHost     int
+
+	protocol string
+}
+
+func newUpstreamOptions(p ProxyConf) (upstreamOptions, error) {
+	o := upstreamOptions{
+		retries:             p.Retry.Attempts,
+		maxIdleConnsPerHost: p.Pool.MaxIdleConnsPerHost,
+		maxConnsPerHost:     p.Pool.MaxConnsPerHost,
+		protocol:            p.Protocol,
+	}
+	var err error
+
+	if o.dialTimeout, err = parseDuration("timeouts.dial", p.Timeouts.Dial); err != nil {
+		return o, err
+	}
+	if o.tlsHandshakeTimeout, err = parseDuration("timeouts.tls_handshake", p.Timeouts.TLSHandshake); err != nil {
+		return o, err
+	}
+	if o.responseHeaderTimeout, err = parseDuration("timeouts.response_header", p.Timeouts.ResponseHeader); err != nil {
+		return o, err
+	}
+	if o.overallTimeout, err = parseDuration("timeouts.overall", p.Timeouts.Overall); err != nil {
+		return o, err
+	}
+	if o.retryBackoff, err = parseDuration("retry.backoff", p.Retry.Backoff); err != nil {
+		return o, err
+	}
+
+	if len(p.Members) > 0 {
+		if o.members, err = parseMembers(p); err != nil {
+			return o, err
+		}
+	}
+
+	if o.retries < 0 {
+		return o, errors.New("retry.attempts must not be negative")
+	}
+	if o.maxIdleConnsPerHost < 0 || o.maxConnsPerHost < 0 {
+		return o, errors.New("pool sizes must not be negative")
+	}
+
+	switch o.protocol {
+	case "", ProtocolHTTP1:
+	case ProtocolH2, ProtocolH2C:
+		if err := checkHTTP2Options(o, p.Dest); err != nil {
+			return o, err
+		}
+	default:
+		return o, fmt.Errorf("invalid protocol: %s (must be %s, %s or %s)", o.protocol, ProtocolHTTP1, ProtocolH2, ProtocolH2C)
+	}
+
+	if o.dialTimeout == 0 {
+		o.dialTimeout = defaultDialTimeout
+	}
+	if o.retryBackoff == 0 {
+		o.retryBackoff = defaultRetryBackoff
+	}
+	return o, nil
+}
+
+func (b *Backend) newTransport() http.RoundTripper {
+	o := b.Upstream
+
+	dialer := &net.Dialer{
+		Timeout:   o.dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	dial := dialer.DialContext
+	if b.Socket != "" {
+		dial = b.dialSocket
+	}
+
+	var rt http.RoundTripper
+	switch o.protocol {
+	case ProtocolH2, ProtocolH2C:
+		rt = b.newHTTP2Transport(dial)
+	default:
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = b.TLSConfig
+		transport.DialContext = dial
+		if o.tlsHandshakeTimeout > 0 {
+			transport.TLSHandshakeTimeout = o.tlsHandshakeTimeout
+		}
+		transport.ResponseHeaderTimeout = o.responseHeaderTimeout
+		if o.maxIdleConnsPerHost > 0 {
+			transport.MaxIdleConnsPerHost = o.maxIdleConnsPerHost
+		}
+		transport.MaxConnsPerHost = o.maxConnsPerHost
+		rt = transport
+	}
+
+	if o.retries > 0 {
+		rt = &retryTransport{rt, o.retries, o.retryBackoff, o.members}
+	}
+	if b.Breaker != nil {
+		rt = &breakerTransport{rt, b.Breaker}
+	}
+	return rt
+}
+
+// parseMembers returns the hosts of dest and members. The URLs aren't part of
+// the errors, they may hold passwords.
+func parseMembers(p ProxyConf) ([]string, error) {
+	dest, err := url.Parse(p.Dest)
+	if err != nil || strings.HasPrefix(p.Dest, "unix://") || (dest.Scheme != "http" && dest.Scheme != "https") || dest.Host == "" {
+		return nil, errors.New("members need an http or https dest")
+	}
+	hosts := []string{dest.Host}
+	for i, m := range p.Members {
+		u, err := url.Parse(m)
+		if err != nil || u.Scheme != dest.Scheme || u.Host == "" {
+			return nil, fmt.Errorf("members[%d] must be a %s URL like dest", i, dest.Scheme)
+		}
+		hosts = append(hosts, u.Host)
+	}
+	return hosts, nil
+}
+
+// memberHost returns the host the next request goes to.
+func (b *Backend) memberHost() string {
+	members := b.Upstream.members
+	if len(members) == 0 {
+		return b.URL.Host
+	}
+	n := atomic.AddUint32(&b.next, 1)
+	return members[(n-1)%uint32(len(members))]
+}
+
+func (b *Backend) dialSocket(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := net.Dialer{Timeout: b.Upstream.dialTimeout}
+	return d.DialContext(ctx, "unix", b.Socket)
+}
+
+// retryTransport retries idempotent requests failing with a transport error,
+// waiting backoff, 2*backoff, 4*backoff... between the attempts. With
+// members, every attempt goes to the next one.
+type retryTransport struct {
+	transport http.RoundTripper
+	retries   int
+	backoff   time.Duration
+	members   []string
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	backoff := t.backoff
+	for i := 0; ; i++ {
+		res, err := t.transport.RoundTrip(req)
+		if err == nil || i >= t.retries || !isRetryable(req) || req.Context().Err() != nil {
+			return res, err
+		}
+
+		log.Printf("retrying %s %s in %s (%d/%d): %s", req.Method, req.URL, backoff, i+1, t.retries, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+		req = t.nextMember(req)
+	}
+}
+
+// nextMember returns a copy of req for the member after the one req was
+// sent to.
+func (t *retryTransport) nextMember(req *http.Request) *http.Request {
+	if len(t.members) < 2 {
+		return req
+	}
+	host := req.URL.Host
+	for i, m := range t.members {
+		if m == req.URL.Host {
+			host = t.members[(i+1)%len(t.members)]
+			break
+		}
+	}
+
+	next := req.Clone(req.Context())
+	next.URL.Host = host
+	if req.Host == req.URL.Host {
+		next.Host = host // host_header: upstream
+	}
+	if req.Header.Get(BackendHostHeader) == req.URL.Host {
+		next.Header.Set(BackendHostHeader, host)
+	}
+	return next
+}
+
+func isRetryable(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+	default:
+		return false
+	}
+	// the body has been consumed by the failed attempt
+	return req.Body == nil || req.Body == http.NoBody
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// errorHandler reports backends which didn't answer in time with 504 and any
+// other failure with 502.
+func (b *Backend) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errCircuitOpen) {
+		b.Breaker.serveOpen(w)
+		return
+	}
+	if isBodyTooLarge(err) {
+		serveBodyTooLarge(w)
+		return
+	}
+
+	status := http.StatusBadGateway
+	if isTimeout(err) {
+		status = http.StatusGatewayTimeout
+	}
+	log.Printf("proxy error for %s: %v", r.URL, err)
+	http.Error(w, fmt.Sprintf("%d %s", status, http.StatusText(status)), status)
+}
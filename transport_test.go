@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestBackendProxy(t *testing.T, dest string, p ProxyConf) *httptest.Server {
+	u, err := url.Parse(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := newUpstreamOptions(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flushInterval, err := parseFlushInterval(p.FlushInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(newVirtualHostReverseProxy([]Backend{{URL: u, Upstream: upstream, FlushInterval: flushInterval}}))
+}
+
+func TestUpstreamTimeouts(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		fmt.Fprint(w, "slow\n")
+	}))
+	defer backend.Close()
+
+	for _, timeouts := range []TimeoutConf{
+		{ResponseHeader: "100ms"},
+		{Overall: "100ms"},
+	} {
+		front := newTestBackendProxy(t, backend.URL, ProxyConf{Timeouts: timeouts})
+		res, err := http.Get(front.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusGatewayTimeout {
+			t.Errorf("unexpected status for %+v: %s", timeouts, res.Status)
+		}
+		front.Close()
+	}
+}
+
+func TestUpstreamRetry(t *testing.T) {
+	var requests int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fail every other request by dropping the connection
+		if atomic.AddInt32(&requests, 1)%2 == 1 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		fmt.Fprint(w, "hello\n")
+	}))
+	defer backend.Close()
+
+	front := newTestBackendProxy(t, backend.URL, ProxyConf{Retry: RetryConf{Attempts: 2, Backoff: "10ms"}})
+	defer front.Close()
+
+	res, err := http.Get(front.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "hello\n" {
+		t.Errorf("GET should have been retried: %s %s", res.Status, body)
+	}
+
+	// not idempotent
+	res, err = http.Post(front.URL+"/", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadGateway {
+		t.Errorf("POST should not have been retried: %s", res.Status)
+	}
+}
+
+func TestUpstreamMembers(t *testing.T) {
+	var hosts []string
+	for _, name := range []string{"a", "b"} {
+		name := name
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, name)
+		}))
+		defer backend.Close()
+		hosts = append(hosts, backend.URL)
+	}
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	p := ProxyConf{Dest: hosts[0], Members: []string{hosts[1]}}
+	front := newTestBackendProxy(t, p.Dest, p)
+	defer front.Close()
+	var answers []string
+	for i := 0; i < 4; i++ {
+		res, err := http.Get(front.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		answers = append(answers, string(body))
+	}
+	if strings.Join(answers, "") != "abab" {
+		t.Errorf("requests not balanced: %v", answers)
+	}
+
+	// retries go to the next member
+	p = ProxyConf{Dest: down.URL, Members: []string{hosts[0]}, Retry: RetryConf{Attempts: 1, Backoff: "10ms"}}
+	front = newTestBackendProxy(t, p.Dest, p)
+	defer front.Close()
+	for i := 0; i < 4; i++ {
+		res, err := http.Get(front.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != "a" {
+			t.Errorf("request %d not retried on another member: %s %s", i, res.Status, body)
+		}
+	}
+
+	for _, p := range []ProxyConf{
+		{Dest: "unix:///run/app.sock", Members: []string{"http://127.0.0.1:8080"}},
+		{Dest: "http://127.0.0.1:8080", Members: []string{"https://127.0.0.1:8443"}},
+		{Dest: "http://127.0.0.1:8080", Members: []string{"127.0.0.1:8081"}},
+	} {
+		if _, err := newUpstreamOptions(p); err == nil {
+			t.Errorf("expected an error for %+v", p)
+		}
+	}
+}
+
+// streamingHandler writes first, flushes and waits for release before writing
+// the rest of the response.
+func streamingHandler(contentType string, contentLength int, first, rest string, release chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		if contentLength > 0 {
+			w.Header().Set("Content-Length", fmt.Sprint(contentLength))
+		}
+		fmt.Fprint(w, first)
+		w.(http.Flusher).Flush()
+		<-release
+		fmt.Fprint(w, rest)
+	}
+}
+
+// readStreamed returns the first line of the response to url, failing if it
+// doesn't arrive while the backend holds back the rest.
+func readStreamed(t *testing.T, url string) string {
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	line := make(chan string, 1)
+	go func() {
+		s, _ := bufio.NewReader(res.Body).ReadString('\n')
+		line <- s
+	}()
+	select {
+	case s := <-line:
+		return s
+	case <-time.After(2 * time.Second):
+		t.Fatal("the first part of the response was not flushed")
+	}
+	return ""
+}
+
+func TestStreamingEventStream(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(streamingHandler("text/event-stream", 0, "data: one\n", "\ndata: two\n\n", release))
+	defer backend.Close()
+	defer close(release) // before closing the backend
+
+	front := newTestBackendProxy(t, backend.URL, ProxyConf{})
+	defer front.Close()
+
+	if s := readStreamed(t, front.URL+"/events"); s != "data: one\n" {
+		t.Errorf("unexpected event: %q", s)
+	}
+}
+
+func TestStreamingFlushInterval(t *testing.T) {
+	release := make(chan struct{})
+	// a known length would otherwise be buffered until the end
+	backend := httptest.NewServer(streamingHandler("text/plain", 10, "first\n", "rest\n", release))
+	defer backend.Close()
+	defer close(release) // before closing the backend
+
+	front := newTestBackendProxy(t, backend.URL, ProxyConf{FlushInterval: "immediate"})
+	defer front.Close()
+
+	if s := readStreamed(t, front.URL+"/download"); s != "first\n" {
+		t.Errorf("unexpected line: %q", s)
+	}
+}
+
+func TestStreamingTrailers(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		fmt.Fprint(w, "part 1\n")
+		w.(http.Flusher).Flush()
+		fmt.Fprint(w, "part 2\n")
+		w.Header().Set("X-Checksum", "abc")
+	}))
+	defer backend.Close()
+
+	front := newTestBackendProxy(t, backend.URL, ProxyConf{})
+	defer front.Close()
+
+	res, err := http.Get(front.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "part 1\npart 2\n" {
+		t.Errorf("unexpected body: %q", body)
+	}
+	if len(res.TransferEncoding) == 0 || res.TransferEncoding[0] != "chunked" {
+		t.Errorf("response not chunked: %v", res.TransferEncoding)
+	}
+	if res.Trailer.Get("X-Checksum") != "abc" {
+		t.Errorf("trailer not passed through: %v", res.Trailer)
+	}
+}
+
+func TestParseFlushInterval(t *testing.T) {
+	tests := []struct {
+		value    string
+		interval time.Duration
+		ok       bool
+	}{
+		{"", 0, true},
+		{"immediate", -1, true},
+		{"-1", -1, true},
+		{"100ms", 100 * time.Millisecond, true},
+		{"-2s", 0, false},
+		{"often", 0, false},
+	}
+	for _, test := range tests {
+		d, err := parseFlushInterval(test.value)
+		if (err == nil) != test.ok || d != test.interval {
+			t.Errorf("%q: unexpected result %s, %v", test.value, d, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "flush_interval") {
+			t.Errorf("%q: error doesn't name the option: %v", test.value, err)
+		}
+	}
+}
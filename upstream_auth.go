@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenFileCheckInterval limits how often a bearer_file is stat'ed for
+// changes.
+const tokenFileCheckInterval = time.Second
+
+// upstreamCredentials are added to every request sent to a backend,
+// replacing whatever Authorization header the client sent.
+type upstreamCredentials struct {
+	username string
+	password string
+	bearer   string
+	file     *tokenFile
+}
+
+func newUpstreamCredentials(c UpstreamAuthConf) (*upstreamCredentials, error) {
+	n := 0
+	if c.Username != "" {
+		n++
+	}
+	if c.Bearer != "" {
+		n++
+	}
+	if c.BearerFile != "" {
+		n++
+	}
+	if n == 0 {
+		if c.Password != "" {
+			return nil, errors.New("upstream_auth.username is required with upstream_auth.password")
+		}
+		return nil, nil
+	}
+	if n > 1 {
+		return nil, errors.New("only one of upstream_auth.username, upstream_auth.bearer and upstream_auth.bearer_file can be set")
+	}
+
+	u := &upstreamCredentials{
+		username: c.Username,
+		password: c.Password,
+		bearer:   c.Bearer,
+	}
+	if c.BearerFile != "" {
+		u.file = &tokenFile{path: c.BearerFile}
+		if err := u.file.load(); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+func (u *upstreamCredentials) apply(req *http.Request) {
+	switch {
+	case u.username != "":
+		req.SetBasicAuth(u.username, u.password)
+	case u.bearer != "":
+		req.Header.Set("Authorization", "Bearer "+u.bearer)
+	case u.file != nil:
+		req.Header.Set("Authorization", "Bearer "+u.file.token())
+	}
+}
+
+// tokenFile holds a token read from a file. The file is re-read when its
+// modification time changes; if that fails the previous token is kept.
+type tokenFile struct {
+	path string
+
+	mu      sync.Mutex
+	value   string
+	modTime time.Time
+	checked time.Time
+}
+
+func (t *tokenFile) token() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if now := time.Now(); now.Sub(t.checked) >= tokenFileCheckInterval {
+		t.checked = now
+		if fi, err := os.Stat(t.path); err != nil {
+			log.Printf("failed to check token file %s: %s", t.path, err)
+		} else if !fi.ModTime().Equal(t.modTime) {
+			if err := t.read(); err != nil {
+				log.Printf("failed to reload token file %s: %s", t.path, err)
+			} else {
+				log.Printf("reloaded token file %s", t.path)
+			}
+		}
+	}
+	return t.value
+}
+
+func (t *tokenFile) load() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.checked = time.Now()
+	return t.read()
+}
+
+func (t *tokenFile) read() error {
+	fi, err := os.Stat(t.path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(t.path)
+	if err != nil {
+		return err
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		return errors.New("token file " + t.path + " is empty")
+	}
+	t.value = value
+	t.modTime = fi.ModTime()
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestUpstreamCredentialsBearerFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Error(err)
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	if err := ioutil.WriteFile(f.Name(), []byte("token1\n"), 0600); err != nil {
+		t.Error(err)
+	}
+
+	u, err := newUpstreamCredentials(UpstreamAuthConf{BearerFile: f.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "http://127.0.0.1/", nil)
+	req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	u.apply(req)
+	if v := req.Header.Get("Authorization"); v != "Bearer token1" {
+		t.Errorf("unexpected Authorization: %s", v)
+	}
+
+	if err := ioutil.WriteFile(f.Name(), []byte("token2\n"), 0600); err != nil {
+		t.Error(err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(f.Name(), future, future)
+	u.file.checked = time.Time{}
+
+	u.apply(req)
+	if v := req.Header.Get("Authorization"); v != "Bearer token2" {
+		t.Errorf("token file was not reloaded: %s", v)
+	}
+}
+
+func TestUpstreamCredentialsConflict(t *testing.T) {
+	if _, err := newUpstreamCredentials(UpstreamAuthConf{Username: "u", Bearer: "b"}); err == nil {
+		t.Errorf("username and bearer together should be an error")
+	}
+}
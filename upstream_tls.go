@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSVersion(name, value string) (uint16, error) {
+	if value == "" {
+		return 0, nil
+	}
+	v, ok := tlsVersions[value]
+	if !ok {
+		return 0, fmt.Errorf("invalid %s: %s (must be one of 1.0, 1.1, 1.2 or 1.3)", name, value)
+	}
+	return v, nil
+}
+
+// newUpstreamTLSConfig returns the TLS client config for a backend, or nil
+// if the defaults should be used.
+func newUpstreamTLSConfig(c UpstreamTLSConf) (*tls.Config, error) {
+	if c == (UpstreamTLSConf{}) {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	minVersion, err := parseTLSVersion("tls.min_version", c.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	config.MinVersion = minVersion
+
+	if c.CAFile != "" {
+		data, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, errors.New("both tls.cert and tls.key are required for a client certificate")
+		}
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func writeServerCA(t *testing.T, server *httptest.Server) string {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	return f.Name()
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isWebsocket(r) {
+			websocketEchoHandler(t)(w, r)
+			return
+		}
+		fmt.Fprint(w, "hello TLS\n")
+	}))
+	defer backend.Close()
+
+	ca := writeServerCA(t, backend)
+	defer os.Remove(ca)
+
+	u, _ := url.Parse(backend.URL)
+	ws, _ := newWebsocketOptions(WebSocketConf{})
+
+	for _, test := range []struct {
+		conf UpstreamTLSConf
+		ok   bool
+	}{
+		{UpstreamTLSConf{}, false},
+		{UpstreamTLSConf{CAFile: ca, ServerName: "example.com"}, true},
+		{UpstreamTLSConf{CAFile: ca, ServerName: "wrong.example.net"}, false},
+		{UpstreamTLSConf{InsecureSkipVerify: true}, true},
+	} {
+		config, err := newUpstreamTLSConfig(test.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		front := httptest.NewServer(newVirtualHostReverseProxy([]Backend{{URL: u, WebSocket: ws, TLSConfig: config}}))
+
+		res, err := http.Get(front.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if test.ok && string(body) != "hello TLS\n" {
+			t.Errorf("unexpected body for %+v: %s", test.conf, body)
+		}
+		if !test.ok && res.StatusCode != http.StatusBadGateway {
+			t.Errorf("unexpected status for %+v: %s", test.conf, res.Status)
+		}
+
+		conn, br, res := dialWebsocketThrough(t, front.Listener.Addr().String(), "/ws")
+		if test.ok {
+			if res.StatusCode != http.StatusSwitchingProtocols {
+				t.Errorf("unexpected websocket status for %+v: %s", test.conf, res.Status)
+			} else {
+				writeFrame(conn, []byte("hello"), []byte{1, 2, 3, 4})
+				if payload, err := readFrame(br); err != nil || string(payload) != "hello" {
+					t.Errorf("unexpected websocket echo: %s %v", payload, err)
+				}
+			}
+		} else if res.StatusCode != http.StatusBadGateway {
+			t.Errorf("unexpected websocket status for %+v: %s", test.conf, res.Status)
+		}
+		conn.Close()
+		front.Close()
+	}
+}
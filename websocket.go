@@ -0,0 +1,598 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultWebsocketConnectTimeout   = 10 * time.Second
+	defaultWebsocketHandshakeTimeout = 10 * time.Second
+)
+
+// hopHeaders are removed from the handshake before it is sent to the
+// backend. Connection and Upgrade are set again afterwards.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type websocketOptions struct {
+	deny             bool
+	allowedOrigins   []string
+	subprotocols     []string
+	connectTimeout   time.Duration
+	handshakeTimeout time.Duration
+	idleTimeout      time.Duration
+}
+
+func newWebsocketOptions(c WebSocketConf) (websocketOptions, error) {
+	o := websocketOptions{
+		allowedOrigins: c.AllowedOrigins,
+		subprotocols:   c.Subprotocols,
+	}
+	var err error
+
+	switch c.Upgrade {
+	case "", WebSocketAllow:
+	case WebSocketDeny:
+		o.deny = true
+	default:
+		return o, fmt.Errorf("websocket.upgrade must be %s or %s: %s", WebSocketAllow, WebSocketDeny, c.Upgrade)
+	}
+
+	if o.connectTimeout, err = parseDuration("websocket.connect_timeout", c.ConnectTimeout); err != nil {
+		return o, err
+	}
+	if o.handshakeTimeout, err = parseDuration("websocket.handshake_timeout", c.HandshakeTimeout); err != nil {
+		return o, err
+	}
+	if o.idleTimeout, err = parseDuration("websocket.idle_timeout", c.IdleTimeout); err != nil {
+		return o, err
+	}
+
+	if o.connectTimeout == 0 {
+		o.connectTimeout = defaultWebsocketConnectTimeout
+	}
+	if o.handshakeTimeout == 0 {
+		o.handshakeTimeout = defaultWebsocketHandshakeTimeout
+	}
+	return o, nil
+}
+
+func isWebsocket(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") &&
+		strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveWebsocket proxies a WebSocket handshake to the backend and, once the
+// backend switched protocols, tunnels the connection in both directions.
+func (b *Backend) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	if err := b.checkWebsocket(r); err != nil {
+		log.Printf("websocket request to %s%s refused: %s", r.Host, r.URL.Path, err)
+		http.Error(w, "WebSocket connection not allowed.", http.StatusForbidden)
+		return
+	}
+
+	b.director(r) // rewrite request headers for backend
+	if strings.HasPrefix(r.URL.Path, "/") == false {
+		r.URL.Path = "/" + r.URL.Path
+	}
+	removeHopHeaders(r.Header)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	appendForwardedFor(r)
+
+	log.Printf("proxy ws request: %s", r.URL.String())
+
+	if b.Breaker != nil && !b.Breaker.allow() {
+		b.Breaker.serveOpen(w)
+		return
+	}
+	d, err := b.dialWebsocket(r.Context(), r.URL)
+	if err != nil {
+		b.recordHandshake(breakerFailure)
+		http.Error(w, "Error contacting backend server.", http.StatusBadGateway)
+		log.Printf("Error dialing websocket backend %s: %v", r.URL.Host, err)
+		return
+	}
+
+	d.SetDeadline(time.Now().Add(b.WebSocket.handshakeTimeout))
+	if err := r.Write(d); err != nil {
+		d.Close()
+		b.recordHandshake(breakerFailure)
+		http.Error(w, "Error contacting backend server.", http.StatusBadGateway)
+		log.Printf("Error copying request to websocket backend %s: %v", r.URL.Host, err)
+		return
+	}
+	br := bufio.NewReader(d)
+	res, err := http.ReadResponse(br, r)
+	if err != nil {
+		d.Close()
+		b.recordHandshake(breakerFailure)
+		http.Error(w, "Error reading response from backend server.", http.StatusBadGateway)
+		log.Printf("Error reading websocket handshake from %s: %v", r.URL.Host, err)
+		return
+	}
+	d.SetDeadline(time.Time{})
+	if res.StatusCode >= 500 {
+		b.recordHandshake(breakerFailure)
+	} else {
+		b.recordHandshake(breakerSuccess)
+	}
+
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		if p := res.Header.Get("Sec-WebSocket-Protocol"); p != "" && !b.subprotocolAllowed(p) {
+			d.Close()
+			http.Error(w, "Error contacting backend server.", http.StatusBadGateway)
+			log.Printf("websocket backend %s selected subprotocol %s which isn't allowed", r.URL.Host, p)
+			return
+		}
+	} else {
+		// the backend refused to upgrade. Only its status is passed on,
+		// the handshake isn't a way to read the backend.
+		log.Printf("websocket backend %s answered %s", r.URL.Host, res.Status)
+		res.Body.Close()
+		d.Close()
+		status := res.StatusCode
+		if status < 200 {
+			status = http.StatusBadGateway
+		}
+		http.Error(w, "WebSocket upgrade refused by backend server.", status)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		d.Close()
+		http.Error(w, "Not a hijacker?", 500)
+		return
+	}
+	nc, bufrw, err := hj.Hijack()
+	if err != nil {
+		d.Close()
+		log.Printf("Hijack error: %v", err)
+		return
+	}
+	nc.SetDeadline(time.Time{})
+
+	if err := writeSwitchingProtocols(nc, res); err != nil {
+		log.Printf("Error writing websocket handshake to client: %v", err)
+		nc.Close()
+		d.Close()
+		return
+	}
+
+	// pass on anything which was read ahead on either side
+	if n := br.Buffered(); n > 0 {
+		data, _ := br.Peek(n)
+		if _, err := nc.Write(data); err != nil {
+			nc.Close()
+			d.Close()
+			return
+		}
+	}
+	if n := bufrw.Reader.Buffered(); n > 0 {
+		data, _ := bufrw.Reader.Peek(n)
+		if _, err := d.Write(data); err != nil {
+			nc.Close()
+			d.Close()
+			return
+		}
+	}
+
+	t := &websocketTunnel{client: nc, backend: d, idle: b.WebSocket.idleTimeout}
+	tunnels.add(t)
+	t.run()
+	tunnels.remove(t)
+	log.Printf("websocket closed: %s", r.URL.String())
+}
+
+// recordHandshake records the outcome of a handshake in the circuit breaker,
+// if the backend has one.
+func (b *Backend) recordHandshake(outcome breakerOutcome) {
+	if b.Breaker != nil {
+		b.Breaker.record(outcome)
+	}
+}
+
+// checkWebsocket enforces the upgrade policy of the route. It has to be
+// called before the request is rewritten for the backend.
+func (b *Backend) checkWebsocket(r *http.Request) error {
+	if b.WebSocket.deny {
+		return errors.New("upgrade denied for this route")
+	}
+
+	// browsers always send an Origin; other clients can forge it anyway
+	if origin := r.Header.Get("Origin"); origin != "" && !b.originAllowed(origin, r.Host) {
+		return fmt.Errorf("origin %s not allowed", origin)
+	}
+
+	if len(b.WebSocket.subprotocols) > 0 {
+		var requested, allowed []string
+		for _, v := range r.Header.Values("Sec-WebSocket-Protocol") {
+			for _, p := range strings.Split(v, ",") {
+				if p = strings.TrimSpace(p); p != "" {
+					requested = append(requested, p)
+					if b.subprotocolAllowed(p) {
+						allowed = append(allowed, p)
+					}
+				}
+			}
+		}
+		if len(requested) > 0 && len(allowed) == 0 {
+			return fmt.Errorf("subprotocols %s not allowed", strings.Join(requested, ", "))
+		}
+		r.Header.Del("Sec-WebSocket-Protocol")
+		if len(allowed) > 0 {
+			r.Header.Set("Sec-WebSocket-Protocol", strings.Join(allowed, ", "))
+		}
+	}
+	return nil
+}
+
+// originAllowed checks the Origin of a handshake. Without allowed_origins
+// only the host of the request itself and the host of the route are allowed.
+// Entries are either full origins ("https://app.example.com"), host names
+// with an optional "*." wildcard or "*" for any origin.
+func (b *Backend) originAllowed(origin, host string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false // including "null"
+	}
+
+	allowed := b.WebSocket.allowedOrigins
+	if len(allowed) == 0 {
+		allowed = []string{host}
+		if b.Host != "" {
+			allowed = append(allowed, b.Host)
+		}
+	}
+
+	for _, a := range allowed {
+		switch {
+		case a == "*":
+			return true
+		case strings.Contains(a, "://"):
+			if strings.EqualFold(strings.TrimSuffix(a, "/"), u.Scheme+"://"+u.Host) {
+				return true
+			}
+		case strings.HasPrefix(a, "*."):
+			if strings.HasSuffix(strings.ToLower(u.Hostname()), strings.ToLower(a[1:])) {
+				return true
+			}
+		default:
+			if strings.EqualFold(a, u.Host) || strings.EqualFold(a, u.Hostname()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (b *Backend) subprotocolAllowed(p string) bool {
+	if len(b.WebSocket.subprotocols) == 0 {
+		return true
+	}
+	for _, a := range b.WebSocket.subprotocols {
+		if a == p {
+			return true
+		}
+	}
+	return false
+}
+
+// dialWebsocket connects to the host of u, the URL of the handshake for the
+// backend.
+func (b *Backend) dialWebsocket(ctx context.Context, u *url.URL) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, b.WebSocket.connectTimeout)
+	defer cancel()
+
+	if b.Socket != "" {
+		return b.dialSocket(ctx, "unix", b.Socket)
+	}
+
+	host := u.Hostname()
+	port := u.Port()
+	secure := u.Scheme == "https" || u.Scheme == "wss"
+	if port == "" {
+		port = "80"
+		if secure {
+			port = "443"
+		}
+	}
+	addr := net.JoinHostPort(host, port)
+
+	if secure {
+		config := &tls.Config{}
+		if b.TLSConfig != nil {
+			config = b.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = host
+		}
+		d := &tls.Dialer{Config: config}
+		return d.DialContext(ctx, "tcp", addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+func writeSwitchingProtocols(w io.Writer, res *http.Response) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "HTTP/1.1 %s\r\n", res.Status)
+	if err := res.Header.Write(bw); err != nil {
+		return err
+	}
+	bw.WriteString("\r\n")
+	return bw.Flush()
+}
+
+// websocketTunnel copies data between client and backend until one of them
+// closes the connection or both have been silent for longer than idle.
+type websocketTunnel struct {
+	client   net.Conn
+	backend  net.Conn
+	idle     time.Duration
+	activity int64 // unix nano of last read on either side
+	closing  int32 // set by goAway
+
+	fromClient  frameBoundary
+	fromBackend frameBoundary
+}
+
+func (t *websocketTunnel) run() {
+	atomic.StoreInt64(&t.activity, time.Now().UnixNano())
+
+	errc := make(chan error, 2)
+	go func() { errc <- t.pipe(t.backend, t.client, &t.fromClient, maskedCloseFrame()) }()
+	go func() { errc <- t.pipe(t.client, t.backend, &t.fromBackend, closeFrame) }()
+
+	if err := <-errc; err != nil {
+		// a broken side can't be closed gracefully; unblock the other one
+		t.client.Close()
+		t.backend.Close()
+	}
+	<-errc
+
+	t.client.Close()
+	t.backend.Close()
+}
+
+// goAway makes both directions stop at the next frame boundary and send a
+// close frame with status 1001 (going away).
+func (t *websocketTunnel) goAway() {
+	atomic.StoreInt32(&t.closing, 1)
+	t.client.SetReadDeadline(time.Now())
+	t.backend.SetReadDeadline(time.Now())
+}
+
+// pipe copies src to dst. On EOF the write side of dst is closed, so the
+// other end sees the close while the opposite direction can still finish.
+// When the tunnel is going away, goingAway is sent to dst instead of the
+// rest of src, unless dst is in the middle of a frame.
+func (t *websocketTunnel) pipe(dst, src net.Conn, frames *frameBoundary, goingAway []byte) error {
+	buf := make([]byte, 32*1024)
+	for {
+		if t.idle > 0 {
+			src.SetReadDeadline(time.Now().Add(t.idle))
+		}
+		if atomic.LoadInt32(&t.closing) != 0 {
+			if frames.atBoundary() {
+				dst.Write(goingAway)
+			}
+			closeWrite(dst)
+			return nil
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			atomic.StoreInt64(&t.activity, time.Now().UnixNano())
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			frames.feed(buf[:n])
+		}
+		if err == io.EOF {
+			closeWrite(dst)
+			return nil
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if atomic.LoadInt32(&t.closing) != 0 {
+					continue
+				}
+				if t.idle > 0 {
+					last := time.Unix(0, atomic.LoadInt64(&t.activity))
+					if time.Since(last) < t.idle {
+						continue // the other direction is still busy
+					}
+					log.Printf("websocket idle for %s, closing", t.idle)
+				}
+			}
+			return err
+		}
+	}
+}
+
+// closeFrame is a close frame with status 1001 (going away) sent by gate as
+// a server.
+var closeFrame = []byte{0x88, 0x02, 0x03, 0xe9}
+
+// maskedCloseFrame is closeFrame as sent by a client, which has to be masked.
+func maskedCloseFrame() []byte {
+	mask := make([]byte, 4)
+	rand.Read(mask)
+	return []byte{0x88, 0x82, mask[0], mask[1], mask[2], mask[3], 0x03 ^ mask[0], 0xe9 ^ mask[1]}
+}
+
+// frameBoundary follows the frames passing in one direction of a tunnel, so
+// that a close frame can be put in between them.
+type frameBoundary struct {
+	header    []byte // of the next frame, as far as it has been read
+	remaining uint64 // payload bytes of the current frame
+}
+
+func (f *frameBoundary) atBoundary() bool {
+	return len(f.header) == 0 && f.remaining == 0
+}
+
+func (f *frameBoundary) feed(p []byte) {
+	for len(p) > 0 {
+		if f.remaining > 0 {
+			n := uint64(len(p))
+			if n > f.remaining {
+				n = f.remaining
+			}
+			f.remaining -= n
+			p = p[n:]
+			continue
+		}
+
+		f.header = append(f.header, p[0])
+		p = p[1:]
+		if len(f.header) < 2 {
+			continue
+		}
+		size := 2
+		switch f.header[1] & 0x7f {
+		case 126:
+			size += 2
+		case 127:
+			size += 8
+		}
+		if f.header[1]&0x80 != 0 {
+			size += 4 // masking key
+		}
+		if len(f.header) < size {
+			continue
+		}
+
+		switch length := f.header[1] & 0x7f; length {
+		case 126:
+			f.remaining = uint64(binary.BigEndian.Uint16(f.header[2:4]))
+		case 127:
+			f.remaining = binary.BigEndian.Uint64(f.header[2:10])
+		default:
+			f.remaining = uint64(length)
+		}
+		f.header = f.header[:0]
+	}
+}
+
+// tunnelSet keeps the open tunnels, so they can be closed on shutdown.
+type tunnelSet struct {
+	mu      sync.Mutex
+	tunnels map[*websocketTunnel]struct{}
+	closing bool
+}
+
+var tunnels = &tunnelSet{tunnels: make(map[*websocketTunnel]struct{})}
+
+// add registers t. Once shutdown started, t goes away right away.
+func (s *tunnelSet) add(t *websocketTunnel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tunnels[t] = struct{}{}
+	if s.closing {
+		atomic.StoreInt32(&t.closing, 1)
+	}
+}
+
+func (s *tunnelSet) remove(t *websocketTunnel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tunnels, t)
+}
+
+// goAway closes all tunnels gracefully and waits for them until ctx is done,
+// then closes the remaining connections.
+func (s *tunnelSet) goAway(ctx context.Context) {
+	s.mu.Lock()
+	s.closing = true
+	if len(s.tunnels) > 0 {
+		log.Printf("closing %d websocket connections", len(s.tunnels))
+	}
+	for t := range s.tunnels {
+		t.goAway()
+	}
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		n := len(s.tunnels)
+		if n == 0 {
+			s.mu.Unlock()
+			return
+		}
+		select {
+		case <-ctx.Done():
+			for t := range s.tunnels {
+				t.client.Close()
+				t.backend.Close()
+			}
+			s.mu.Unlock()
+			return
+		default:
+		}
+		s.mu.Unlock()
+		<-ticker.C
+	}
+}
+
+func closeWrite(c net.Conn) {
+	switch conn := c.(type) {
+	case *net.TCPConn:
+		conn.CloseWrite()
+	case *tls.Conn:
+		conn.CloseWrite()
+	default:
+		c.Close()
+	}
+}
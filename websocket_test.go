@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// websocketEchoHandler is a minimal WebSocket server echoing text frames.
+func websocketEchoHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isWebsocket(r) {
+			http.Error(w, "not a websocket request", http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("Keep-Alive") != "" || r.Header.Get("Proxy-Authorization") != "" {
+			t.Errorf("hop-by-hop headers passed to backend: %v", r.Header)
+		}
+
+		h := sha1.New()
+		io.WriteString(h, r.Header.Get("Sec-WebSocket-Key")+"258EAFA5-E914-47DA-95CA-C5AB0DC85B11")
+		accept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+		conn, bufrw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		bufrw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+		bufrw.WriteString("Sec-WebSocket-Accept: " + accept + "\r\n\r\n")
+		bufrw.Flush()
+
+		for {
+			payload, err := readFrame(bufrw.Reader)
+			if err != nil {
+				return
+			}
+			writeFrame(conn, payload, nil)
+		}
+	}
+}
+
+// readFrame reads a single small frame, unmasking it if needed.
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	masked := header[1]&0x80 != 0
+	length := int(header[1] & 0x7f)
+	var mask []byte
+	if masked {
+		mask = make([]byte, 4)
+		if _, err := io.ReadFull(r, mask); err != nil {
+			return nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	for i := range payload {
+		if masked {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return payload, nil
+}
+
+func writeFrame(w io.Writer, payload []byte, mask []byte) error {
+	frame := []byte{0x81, byte(len(payload))}
+	data := append([]byte{}, payload...)
+	if mask != nil {
+		frame[1] |= 0x80
+		frame = append(frame, mask...)
+		for i := range data {
+			data[i] ^= mask[i%4]
+		}
+	}
+	_, err := w.Write(append(frame, data...))
+	return err
+}
+
+func dialWebsocketThrough(t *testing.T, addr, path string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "http://"+addr+path, nil)
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, br, res
+}
+
+func newTestWebsocketProxy(t *testing.T, dest string, c WebSocketConf) *httptest.Server {
+	u, err := url.Parse(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws, err := newWebsocketOptions(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := newVirtualHostReverseProxy([]Backend{{URL: u, WebSocket: ws}})
+	return httptest.NewServer(proxy)
+}
+
+func TestWebsocketProxy(t *testing.T) {
+	backend := httptest.NewServer(websocketEchoHandler(t))
+	defer backend.Close()
+
+	front := newTestWebsocketProxy(t, backend.URL, WebSocketConf{})
+	defer front.Close()
+
+	conn, br, res := dialWebsocketThrough(t, front.Listener.Addr().String(), "/ws")
+	defer conn.Close()
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status: %s", res.Status)
+	}
+	if res.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("unexpected Sec-WebSocket-Accept: %s", res.Header.Get("Sec-WebSocket-Accept"))
+	}
+
+	for _, msg := range []string{"hello", "world"} {
+		if err := writeFrame(conn, []byte(msg), []byte{1, 2, 3, 4}); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		payload, err := readFrame(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(payload) != msg {
+			t.Errorf("unexpected echo: %s", payload)
+		}
+	}
+}
+
+func TestWebsocketProxyIdleTimeout(t *testing.T) {
+	backend := httptest.NewServer(websocketEchoHandler(t))
+	defer backend.Close()
+
+	front := newTestWebsocketProxy(t, backend.URL, WebSocketConf{IdleTimeout: "200ms"})
+	defer front.Close()
+
+	conn, br, res := dialWebsocketThrough(t, front.Listener.Addr().String(), "/ws")
+	defer conn.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status: %s", res.Status)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("expected the idle tunnel to be closed, got %v", err)
+	}
+}
+
+func TestWebsocketProxyRefused(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no websockets here", http.StatusForbidden)
+	}))
+	defer backend.Close()
+
+	front := newTestWebsocketProxy(t, backend.URL, WebSocketConf{})
+	defer front.Close()
+
+	conn, _, res := dialWebsocketThrough(t, front.Listener.Addr().String(), "/ws")
+	defer conn.Close()
+
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("unexpected status: %s", res.Status)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if strings.Contains(string(body), "no websockets here") {
+		t.Errorf("backend answer relayed: %s", body)
+	}
+}
+
+func TestWebsocketProxyBreaker(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	ws, _ := newWebsocketOptions(WebSocketConf{})
+	cb, err := newCircuitBreaker("/", CircuitBreakerConf{ConsecutiveFailures: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(newVirtualHostReverseProxy([]Backend{{URL: u, WebSocket: ws, Breaker: cb}}))
+	defer front.Close()
+
+	for i := 0; i < 2; i++ {
+		conn, _, res := dialWebsocketThrough(t, front.Listener.Addr().String(), "/ws")
+		conn.Close()
+		if res.StatusCode != http.StatusInternalServerError {
+			t.Fatalf("unexpected status: %s", res.Status)
+		}
+	}
+	if cb.status().State != "open" {
+		t.Errorf("breaker should be open after failed handshakes: %+v", cb.status())
+	}
+}
+
+func TestWebsocketProxyBackendDown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	front := newTestWebsocketProxy(t, "http://"+addr, WebSocketConf{ConnectTimeout: "1s"})
+	defer front.Close()
+
+	conn, _, res := dialWebsocketThrough(t, front.Listener.Addr().String(), "/ws")
+	defer conn.Close()
+
+	if res.StatusCode != http.StatusBadGateway {
+		t.Fatalf("unexpected status: %s", res.Status)
+	}
+}
+
+func TestWebsocketPolicy(t *testing.T) {
+	tests := []struct {
+		conf     WebSocketConf
+		host     string
+		origin   string
+		protocol string
+		allowed  bool
+	}{
+		{WebSocketConf{}, "gate.example.com", "", "", true},
+		{WebSocketConf{}, "gate.example.com", "https://gate.example.com", "", true},
+		{WebSocketConf{}, "gate.example.com", "https://evil.example.net", "", false},
+		{WebSocketConf{}, "gate.example.com", "null", "", false},
+		{WebSocketConf{}, "foo.example.com", "https://foo.example.com", "", true},
+		{WebSocketConf{AllowedOrigins: []string{"https://app.example.com"}}, "gate.example.com", "https://app.example.com", "", true},
+		{WebSocketConf{AllowedOrigins: []string{"https://app.example.com"}}, "gate.example.com", "http://app.example.com", "", false},
+		{WebSocketConf{AllowedOrigins: []string{"https://app.example.com"}}, "gate.example.com", "https://gate.example.com", "", false},
+		{WebSocketConf{AllowedOrigins: []string{"*.example.com"}}, "gate.example.com", "https://a.b.example.com", "", true},
+		{WebSocketConf{AllowedOrigins: []string{"*"}}, "gate.example.com", "https://evil.example.net", "", true},
+		{WebSocketConf{Upgrade: WebSocketDeny}, "gate.example.com", "", "", false},
+		{WebSocketConf{Subprotocols: []string{"graphql-ws"}}, "gate.example.com", "", "graphql-ws, chat", true},
+		{WebSocketConf{Subprotocols: []string{"graphql-ws"}}, "gate.example.com", "", "chat", false},
+	}
+
+	for i, test := range tests {
+		ws, err := newWebsocketOptions(test.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := &Backend{Host: "foo.example.com", WebSocket: ws}
+		r, _ := http.NewRequest("GET", "http://"+test.host+"/ws", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if test.protocol != "" {
+			r.Header.Set("Sec-WebSocket-Protocol", test.protocol)
+		}
+		err = b.checkWebsocket(r)
+		if (err == nil) != test.allowed {
+			t.Errorf("test %d: unexpected result: %v", i, err)
+		}
+		if err == nil && test.protocol != "" && r.Header.Get("Sec-WebSocket-Protocol") != "graphql-ws" {
+			t.Errorf("test %d: subprotocols not filtered: %s", i, r.Header.Get("Sec-WebSocket-Protocol"))
+		}
+	}
+}
+
+func TestWebsocketProxyDeny(t *testing.T) {
+	backend := httptest.NewServer(websocketEchoHandler(t))
+	defer backend.Close()
+
+	front := newTestWebsocketProxy(t, backend.URL, WebSocketConf{Upgrade: WebSocketDeny})
+	defer front.Close()
+
+	conn, _, res := dialWebsocketThrough(t, front.Listener.Addr().String(), "/ws")
+	defer conn.Close()
+
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("unexpected status: %s", res.Status)
+	}
+}
+
+func TestFrameBoundary(t *testing.T) {
+	var f frameBoundary
+	// masked "hello", split in the middle of the header and the payload
+	frame := []byte{0x81, 0x85, 1, 2, 3, 4, 'h' ^ 1, 'e' ^ 2, 'l' ^ 3, 'l' ^ 4, 'o' ^ 1}
+	for _, part := range [][]byte{frame[:1], frame[1:4], frame[4:8]} {
+		f.feed(part)
+		if f.atBoundary() {
+			t.Errorf("boundary in the middle of the frame: %+v", f)
+		}
+	}
+	f.feed(frame[8:])
+	if !f.atBoundary() {
+		t.Errorf("no boundary after the frame: %+v", f)
+	}
+
+	// 16 bit length, followed by an empty frame and the start of another
+	long := append([]byte{0x82, 126, 0x01, 0x00}, make([]byte, 256)...)
+	long = append(long, 0x89, 0x00, 0x81)
+	f.feed(long)
+	if f.atBoundary() {
+		t.Error("boundary within a header")
+	}
+	f.feed([]byte{0x00})
+	if !f.atBoundary() {
+		t.Errorf("no boundary after the frames: %+v", f)
+	}
+}
+
+func TestWebsocketGoAway(t *testing.T) {
+	defer testTunnels()()
+
+	backend := httptest.NewServer(websocketEchoHandler(t))
+	defer backend.Close()
+
+	front := newTestWebsocketProxy(t, backend.URL, WebSocketConf{IdleTimeout: "1m"})
+	defer front.Close()
+
+	conn, br, res := dialWebsocketThrough(t, front.Listener.Addr().String(), "/ws")
+	defer conn.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status: %s", res.Status)
+	}
+	writeFrame(conn, []byte("hello"), []byte{1, 2, 3, 4})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if payload, err := readFrame(br); err != nil || string(payload) != "hello" {
+		t.Fatalf("unexpected echo: %q, %v", payload, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tunnels.goAway(ctx)
+	if ctx.Err() != nil {
+		t.Fatal("tunnel not closed in time")
+	}
+
+	close := make([]byte, 4)
+	if _, err := io.ReadFull(br, close); err != nil || string(close) != string(closeFrame) {
+		t.Errorf("unexpected close frame: %x, %v", close, err)
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("expected the connection to be closed, got %v", err)
+	}
+}